@@ -1,5 +1,10 @@
 package sip
 
+import (
+	"errors"
+	"strings"
+)
+
 type UserInfo interface {
 	GetUsername() string
 	GetType() string
@@ -28,6 +33,61 @@ func (d *DigestUserInfoImpl) GetType() string {
 	return "DIGEST"
 }
 
+// Credentials implements CredentialProvider with the same password for
+// every realm.
+func (d *DigestUserInfoImpl) Credentials(realm string, method string, uri string) (Credentials, error) {
+	return Credentials{Username: d.username, Password: d.password}, nil
+}
+
+// Credentials answer a digest challenge. HA1 holds the hex encoded hash
+// of "username:realm:password" by algorithm, e.g. "MD5" or "SHA-256",
+// which allows to keep passwords out of memory. Password is used for
+// algorithms without HA1. Username defaults to the username of the
+// UserInfo.
+type Credentials struct {
+	Username string
+	Password string
+	HA1      map[string]string
+}
+
+// ha1For returns the HA1 for a challenge with algorithm, the -sess
+// variants using the HA1 of their base algorithm. It returns "" if the
+// password is to be used.
+func (c Credentials) ha1For(algorithm string) (string, error) {
+	name := strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS")
+	if name == "" {
+		name = "MD5"
+	}
+	for a, ha1 := range c.HA1 {
+		if strings.EqualFold(a, name) {
+			return ha1, nil
+		}
+	}
+	if len(c.HA1) > 0 && c.Password == "" {
+		return "", errors.New("No credentials for algorithm " + name)
+	}
+	return "", nil
+}
+
+// CredentialProvider looks up the credentials for a request to uri with
+// method, challenged for realm. It is called for every request, so that
+// secrets can be fetched from an external store when needed.
+type CredentialProvider interface {
+	Credentials(realm string, method string, uri string) (Credentials, error)
+}
+
+type ProviderUserInfoImpl struct {
+	UserInfoImpl
+	provider CredentialProvider
+}
+
+func (p *ProviderUserInfoImpl) Credentials(realm string, method string, uri string) (Credentials, error) {
+	return p.provider.Credentials(realm, method, uri)
+}
+func (p *ProviderUserInfoImpl) GetType() string {
+	return "DIGEST"
+}
+
 func UnauthorizedUserInfo(username string) UserInfo {
 	return &UserInfoImpl{
 		username,
@@ -42,3 +102,12 @@ func DigestUserInfo(username string, password string) UserInfo {
 		password,
 	}
 }
+
+func ProviderUserInfo(username string, provider CredentialProvider) UserInfo {
+	return &ProviderUserInfoImpl{
+		UserInfoImpl{
+			username,
+		},
+		provider,
+	}
+}
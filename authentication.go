@@ -2,11 +2,28 @@ package sip
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
 	"errors"
 	"fmt"
+	"hash"
+	"log"
 	"strings"
 )
 
+type digestAlgorithm struct {
+	hash     func() hash.Hash
+	strength int
+}
+
+// digestAlgorithms lists the supported digest algorithms (RFC 7616,
+// RFC 8760) without their -sess suffix.
+var digestAlgorithms = map[string]digestAlgorithm{
+	"MD5":         {md5.New, 1},
+	"SHA-256":     {sha256.New, 2},
+	"SHA-512-256": {sha512.New512_256, 3},
+}
+
 type WWWAuthenticate interface {
 	GetMechanism() string
 }
@@ -23,59 +40,211 @@ type DigestWWWAuthenticate struct {
 	Realm     string
 	Nonce     string
 	Algorithm string
+	Opaque    string
+	Domain    string
+	Qop       []string
+	Stale     bool
+
+	// Proxy is set for challenges received in Proxy-Authenticate, which
+	// are answered in Proxy-Authorization.
+	Proxy bool
 }
 
 func (w DigestWWWAuthenticate) GetMechanism() string {
 	return "DIGEST"
 }
 
+// ParseWWWAuthenticate parses a WWW-Authenticate or Proxy-Authenticate
+// header line.
 func ParseWWWAuthenticate(line HeaderLine) (WWWAuthenticate, error) {
-	var auth WWWAuthenticate
-	if strings.ToLower(line.Name) != "www-authenticate" {
-		return WWWAuthenticateImpl{}, errors.New("Not a WWW-Authenticate line")
-	}
-	authenticateLine := strings.SplitN(line.Value, " ", 2)
-
-	switch strings.ToUpper(authenticateLine[0]) {
-	case "DIGEST":
-		authDigest := DigestWWWAuthenticate{}
-		digestParams := strings.Split(authenticateLine[1], ", ")
-		for _, item := range digestParams {
-			itemCombo := strings.Split(item, "=")
-			itemName := itemCombo[0]
-			itemValue := itemCombo[1]
-
-			switch strings.ToLower(itemName) {
-			case "realm":
-				authDigest.Realm = itemValue
-			case "nonce":
-				authDigest.Nonce = itemValue
-			case "algorithm":
-				authDigest.Algorithm = itemValue
+	name := canonicalHeaderName(line.Name)
+	if name != "WWW-Authenticate" && name != "Proxy-Authenticate" {
+		return WWWAuthenticateImpl{}, errors.New("Not a WWW-Authenticate or Proxy-Authenticate line")
+	}
+	authenticateLine := strings.SplitN(strings.TrimSpace(line.Value), " ", 2)
+	if strings.ToUpper(authenticateLine[0]) != "DIGEST" {
+		return WWWAuthenticateImpl{authenticateLine[0]}, nil
+	}
+	if len(authenticateLine) < 2 {
+		return WWWAuthenticateImpl{}, errors.New("Digest challenge without parameters")
+	}
+
+	authDigest := DigestWWWAuthenticate{}
+	authDigest.Mechanism = authenticateLine[0]
+	authDigest.Proxy = name == "Proxy-Authenticate"
+	for itemName, itemValue := range parseDigestParams(authenticateLine[1]) {
+		switch itemName {
+		case "realm":
+			authDigest.Realm = itemValue
+		case "nonce":
+			authDigest.Nonce = itemValue
+		case "algorithm":
+			authDigest.Algorithm = itemValue
+		case "opaque":
+			authDigest.Opaque = itemValue
+		case "domain":
+			authDigest.Domain = itemValue
+		case "stale":
+			authDigest.Stale = strings.EqualFold(itemValue, "true")
+		case "qop":
+			for _, qop := range strings.Split(itemValue, ",") {
+				authDigest.Qop = append(authDigest.Qop, strings.ToLower(strings.TrimSpace(qop)))
 			}
 		}
-		auth = authDigest
 	}
+	if authDigest.Nonce == "" {
+		return authDigest, errors.New("Digest challenge without nonce")
+	}
+	return authDigest, nil
+}
+
+// parseDigestParams parses the comma separated auth-params of a digest
+// challenge or response. Names are lowercased and values unquoted.
+func parseDigestParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, item := range splitOutside(s, ",") {
+		itemCombo := strings.SplitN(item, "=", 2)
+		if len(itemCombo) != 2 {
+			continue
+		}
+		itemName := strings.ToLower(strings.TrimSpace(itemCombo[0]))
+		params[itemName] = unquote(strings.TrimSpace(itemCombo[1]))
+	}
+	return params
+}
+
+// AuthorizationHeaderName returns the header answering this challenge.
+func (w DigestWWWAuthenticate) AuthorizationHeaderName() string {
+	if w.Proxy {
+		return "Proxy-Authorization"
+	}
+	return "Authorization"
+}
+
+// IsSession tells whether the challenge uses a -sess algorithm.
+func (w DigestWWWAuthenticate) IsSession() bool {
+	return strings.HasSuffix(strings.ToUpper(w.Algorithm), "-SESS")
+}
+
+// algorithm returns the algorithm of the challenge, MD5 if none is given.
+// ok is false for unsupported algorithms.
+func (w DigestWWWAuthenticate) algorithm() (digestAlgorithm, bool) {
+	name := strings.TrimSuffix(strings.ToUpper(w.Algorithm), "-SESS")
+	if name == "" {
+		name = "MD5"
+	}
+	algorithm, ok := digestAlgorithms[name]
+	return algorithm, ok
+}
 
-	return auth, nil
+// Strength orders challenges by the security of their algorithm. It is 0
+// for unsupported algorithms.
+func (w DigestWWWAuthenticate) Strength() int {
+	algorithm, _ := w.algorithm()
+	return algorithm.strength
 }
 
+func (w DigestWWWAuthenticate) offersQop(qop string) bool {
+	for _, offered := range w.Qop {
+		if offered == qop {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthInformation holds everything needed to answer a digest challenge.
+// HA1 is used instead of Password if set. Method and URL are the method
+// and Request-URI of the authorized request. Qop, Cnonce and NonceCount
+// are chosen automatically if left empty. Body is only used for
+// qop=auth-int.
 type AuthInformation struct {
 	Wwwauth  DigestWWWAuthenticate
 	Username string
 	Password string
+	HA1      string
+	Method   string
 	URL      string
+
+	Qop        string
+	Cnonce     string
+	NonceCount uint32
+	Body       []byte
+}
+
+// prepare selects the quality of protection offered by the challenge,
+// preferring auth over auth-int, and generates the client nonce.
+func (a *AuthInformation) prepare() {
+	if a.Qop == "" {
+		switch {
+		case a.Wwwauth.offersQop("auth"):
+			a.Qop = "auth"
+		case a.Wwwauth.offersQop("auth-int"):
+			a.Qop = "auth-int"
+		}
+	}
+	if a.Qop != "" {
+		if a.Cnonce == "" {
+			a.Cnonce = RandSeq(16)
+		}
+		if a.NonceCount == 0 {
+			a.NonceCount = 1
+		}
+	}
 }
 
+func (a *AuthInformation) hash(data string) string {
+	algorithm, ok := a.Wwwauth.algorithm()
+	if !ok {
+		log.Println("Unsupported digest algorithm ", a.Wwwauth.Algorithm, ", using MD5")
+		algorithm = digestAlgorithms["MD5"]
+	}
+	h := algorithm.hash()
+	h.Write([]byte(data))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// FinalHash computes the digest response as specified in RFC 2617 and
+// RFC 7616, or RFC 2069 if the challenge offered no qop.
 func (a *AuthInformation) FinalHash() string {
-	ha1 := md5.Sum([]byte(a.Username + ":" + a.Wwwauth.Realm + ":" + a.Password))
-	ha1s := fmt.Sprintf("%x", ha1)
+	ha1 := a.HA1
+	if ha1 == "" {
+		ha1 = a.hash(a.Username + ":" + a.Wwwauth.Realm + ":" + a.Password)
+	}
+	if a.Wwwauth.IsSession() {
+		ha1 = a.hash(ha1 + ":" + a.Wwwauth.Nonce + ":" + a.Cnonce)
+	}
 
-	ha2 := md5.Sum([]byte("REGISTER:" + "sip:" + a.URL))
-	ha2s := fmt.Sprintf("%x", ha2)
+	ha2 := a.hash(a.Method + ":" + a.URL)
+	if a.Qop == "auth-int" {
+		ha2 = a.hash(a.Method + ":" + a.URL + ":" + a.hash(string(a.Body)))
+	}
 
-	finalHash := md5.Sum([]byte(ha1s + ":" + a.Wwwauth.Nonce + ":" + ha2s))
-	finalHashs := fmt.Sprintf("%x", finalHash)
-	return finalHashs
+	if a.Qop == "" {
+		return a.hash(ha1 + ":" + a.Wwwauth.Nonce + ":" + ha2)
+	}
+	return a.hash(ha1 + ":" + a.Wwwauth.Nonce + ":" + fmt.Sprintf("%08x", a.NonceCount) + ":" + a.Cnonce + ":" + a.Qop + ":" + ha2)
+}
 
+// AuthorizationValue returns the value of the Authorization or
+// Proxy-Authorization header answering the challenge.
+func (a *AuthInformation) AuthorizationValue() string {
+	a.prepare()
+	params := []string{
+		"username=" + quote(a.Username),
+		"realm=" + quote(a.Wwwauth.Realm),
+		"nonce=" + quote(a.Wwwauth.Nonce),
+		"uri=" + quote(a.URL),
+		fmt.Sprintf(`response="%s"`, a.FinalHash()),
+	}
+	if a.Wwwauth.Algorithm != "" {
+		params = append(params, "algorithm="+a.Wwwauth.Algorithm)
+	}
+	if a.Qop != "" {
+		params = append(params, "cnonce="+quote(a.Cnonce), "qop="+a.Qop, fmt.Sprintf("nc=%08x", a.NonceCount))
+	}
+	if a.Wwwauth.Opaque != "" {
+		params = append(params, "opaque="+quote(a.Wwwauth.Opaque))
+	}
+	return "Digest " + strings.Join(params, ", ")
 }
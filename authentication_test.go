@@ -0,0 +1,148 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test vectors from RFC 2617, section 3.5, and RFC 7616, sections 3.9.1
+// and 3.9.2.
+var digestVectors = []struct {
+	name      string
+	challenge string
+	username  string
+	password  string
+	method    string
+	uri       string
+	cnonce    string
+	response  string
+}{
+	{
+		name:      "RFC 2617",
+		challenge: `Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+		username:  "Mufasa",
+		password:  "Circle Of Life",
+		method:    "GET",
+		uri:       "/dir/index.html",
+		cnonce:    "0a4f113b",
+		response:  "6629fae49393a05397450978507c4ef1",
+	},
+	{
+		name:      "RFC 7616 MD5",
+		challenge: `Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=MD5, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+		username:  "Mufasa",
+		password:  "Circle of Life",
+		method:    "GET",
+		uri:       "/dir/index.html",
+		cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+		response:  "8ca523f5e9506fed4657c9700eebdbec",
+	},
+	{
+		name:      "RFC 7616 SHA-256",
+		challenge: `Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+		username:  "Mufasa",
+		password:  "Circle of Life",
+		method:    "GET",
+		uri:       "/dir/index.html",
+		cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+		response:  "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	},
+	{
+		name:      "RFC 7616 SHA-512-256",
+		challenge: `Digest realm="api@example.org", qop="auth", algorithm=SHA-512-256, nonce="5TsQWLVdgBdmrQ0XsxbDODV+57QdFR34I9HAbC/RVvkK", opaque="HRPCssKJSGjCrkzDg8OhwpzCiGPChXYjwrI2QmXDnsOS", charset=UTF-8, userhash=true`,
+		username:  "Jäsøn Doe",
+		password:  "Secret, or not?",
+		method:    "GET",
+		uri:       "/doe.json",
+		cnonce:    "NTg6RKcb9boFIAS3KrFK9BGeh+iDa/sm6jUMp2wds69v",
+		// RFC 7616 prints ae66e67d..., which is computed with SHA-512
+		// truncated to 256 bits rather than SHA-512/256 (FIPS 180-4), as
+		// its userhash is. This is the response for SHA-512/256.
+		response: "3798d4131c277846293534c3edc11bd8a5e4cdcbff78b05db9d95eeb1cec68a5",
+	},
+}
+
+func TestDigestVectors(t *testing.T) {
+	for _, vector := range digestVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			challenge, err := ParseWWWAuthenticate(HeaderLine{"WWW-Authenticate", vector.challenge})
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := AuthInformation{
+				Wwwauth:  challenge.(DigestWWWAuthenticate),
+				Username: vector.username,
+				Password: vector.password,
+				Method:   vector.method,
+				URL:      vector.uri,
+				Cnonce:   vector.cnonce,
+			}
+			value := a.AuthorizationValue()
+			if a.Qop != "auth" || a.NonceCount != 1 {
+				t.Fatalf("Got qop %s and nc %d, expected auth and 1", a.Qop, a.NonceCount)
+			}
+			if response := a.FinalHash(); response != vector.response {
+				t.Fatalf("Got response %s, expected %s", response, vector.response)
+			}
+			if !strings.Contains(value, `response="`+vector.response+`"`) || !strings.Contains(value, "nc=00000001") {
+				t.Fatalf("Unexpected Authorization: %s", value)
+			}
+		})
+	}
+}
+
+func TestCredentialsHA1(t *testing.T) {
+	credentials := Credentials{HA1: map[string]string{"MD5": "md5", "sha-256": "sha256"}}
+	for algorithm, want := range map[string]string{"": "md5", "MD5-sess": "md5", "SHA-256": "sha256", "SHA-256-sess": "sha256"} {
+		if ha1, err := credentials.ha1For(algorithm); err != nil || ha1 != want {
+			t.Errorf("Got %s, %v for %s, expected %s", ha1, err, algorithm, want)
+		}
+	}
+	if _, err := credentials.ha1For("SHA-512-256"); err == nil {
+		t.Error("Missing HA1 without password accepted")
+	}
+	credentials.Password = "secret"
+	if ha1, err := credentials.ha1For("SHA-512-256"); err != nil || ha1 != "" {
+		t.Errorf("Got %s, %v, expected the password to be used", ha1, err)
+	}
+
+	// The vectors answered with HA1 for their algorithm only.
+	for _, vector := range digestVectors {
+		challenge, _ := ParseWWWAuthenticate(HeaderLine{"WWW-Authenticate", vector.challenge})
+		wwwauth := challenge.(DigestWWWAuthenticate)
+		a := AuthInformation{Wwwauth: wwwauth, Method: vector.method, URL: vector.uri, Cnonce: vector.cnonce}
+		name := wwwauth.Algorithm
+		if name == "" {
+			name = "MD5"
+		}
+		credentials := Credentials{HA1: map[string]string{name: a.hash(vector.username + ":" + wwwauth.Realm + ":" + vector.password)}}
+		ha1, err := credentials.ha1For(wwwauth.Algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Username = vector.username
+		a.HA1 = ha1
+		a.AuthorizationValue()
+		if response := a.FinalHash(); response != vector.response {
+			t.Errorf("%s: got response %s, expected %s", vector.name, response, vector.response)
+		}
+	}
+}
+
+func TestAuthorizationQuoting(t *testing.T) {
+	a := AuthInformation{
+		Wwwauth:  DigestWWWAuthenticate{Realm: `example "com"`, Nonce: "abc", Qop: []string{"auth"}},
+		Username: `al"ice\`,
+		Password: "secret",
+		Method:   "REGISTER",
+		URL:      "sip:example.com",
+	}
+	value := a.AuthorizationValue()
+	if !strings.Contains(value, `username="al\"ice\\"`) || !strings.Contains(value, `realm="example \"com\""`) {
+		t.Fatal(value)
+	}
+	params := parseDigestParams(strings.TrimPrefix(value, "Digest "))
+	if params["username"] != a.Username || params["realm"] != a.Wwwauth.Realm || params["uri"] != a.URL {
+		t.Fatal(params)
+	}
+}
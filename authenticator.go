@@ -0,0 +1,285 @@
+package sip
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserStore looks up the credentials of the users allowed to send
+// requests to us. ok is false for unknown users.
+type UserStore interface {
+	Lookup(username string, realm string) (credentials Credentials, ok bool)
+}
+
+// UserMap is a UserStore holding passwords by username, valid for every
+// realm.
+type UserMap map[string]string
+
+func (u UserMap) Lookup(username string, realm string) (Credentials, bool) {
+	password, ok := u[username]
+	return Credentials{Username: username, Password: password}, ok
+}
+
+// DefaultNonceExpiry is how long nonces issued by an Authenticator are
+// accepted.
+var DefaultNonceExpiry = 5 * time.Minute
+
+// nonceCacheSize bounds the nonces whose counts an Authenticator tracks.
+const nonceCacheSize = 4096
+
+// Authenticator challenges incoming requests with digest authentication
+// (RFC 3261, section 22.4). Nonces carry the time they were issued and an
+// HMAC of it, so that they need no state until they are used. They expire
+// after NonceExpiry, and every nonce count is only accepted once, so that
+// responses cannot be replayed.
+type Authenticator struct {
+	Realm       string
+	Users       UserStore
+	Algorithm   string
+	NonceExpiry time.Duration
+
+	// Proxy makes the Authenticator challenge with 407 and
+	// Proxy-Authenticate instead of 401 and WWW-Authenticate.
+	Proxy bool
+
+	mutex  sync.Mutex
+	secret []byte
+	// nonces holds the last count of the used nonces, in order of their
+	// first use. Nonces issued before oldest which are not in nonces
+	// anymore are rejected as stale.
+	nonces map[string]*issuedNonce
+	order  []string
+	oldest time.Time
+}
+
+type issuedNonce struct {
+	issued     time.Time
+	nonceCount uint64
+}
+
+func NewAuthenticator(realm string, users UserStore) *Authenticator {
+	return &Authenticator{
+		Realm:       realm,
+		Users:       users,
+		Algorithm:   "MD5",
+		NonceExpiry: DefaultNonceExpiry,
+		nonces:      make(map[string]*issuedNonce),
+	}
+}
+
+func (a *Authenticator) headerNames() (string, string) {
+	if a.Proxy {
+		return "Proxy-Authenticate", "Proxy-Authorization"
+	}
+	return "WWW-Authenticate", "Authorization"
+}
+
+// Authenticate checks the credentials of req. It returns the name of the
+// authenticated user, or the 401 or 407 response to send instead of
+// processing req.
+func (a *Authenticator) Authenticate(req *Message) (string, *Message) {
+	_, authorizationName := a.headerNames()
+	stale := false
+	for _, line := range req.Headers.FindHeadersByName(authorizationName) {
+		username, err := a.verify(req, line.Value)
+		if err == nil {
+			return username, nil
+		}
+		if err == errStaleNonce {
+			stale = true
+		}
+		log.Println("Rejecting credentials: ", err)
+	}
+	return "", a.challenge(req, stale)
+}
+
+type authenticationError string
+
+func (e authenticationError) Error() string {
+	return string(e)
+}
+
+const errStaleNonce = authenticationError("Nonce expired")
+
+// verify checks a single Authorization header value for our realm.
+func (a *Authenticator) verify(req *Message, value string) (string, error) {
+	request, ok := req.Headline.(RequestHeadline)
+	scheme := strings.SplitN(strings.TrimSpace(value), " ", 2)
+	if !ok || len(scheme) != 2 || !strings.EqualFold(scheme[0], "Digest") {
+		return "", authenticationError("Not a digest response")
+	}
+	params := parseDigestParams(scheme[1])
+	if params["realm"] != a.Realm {
+		return "", authenticationError("Wrong realm " + params["realm"])
+	}
+	if params["uri"] != request.Uri.String() {
+		return "", authenticationError("Digest uri " + params["uri"] + " does not match Request-URI")
+	}
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	if !strings.EqualFold(algorithm, a.algorithm()) {
+		return "", authenticationError("Wrong algorithm " + algorithm)
+	}
+	credentials, ok := a.Users.Lookup(params["username"], a.Realm)
+	if !ok {
+		return "", authenticationError("Unknown user " + params["username"])
+	}
+	ha1, err := credentials.ha1For(algorithm)
+	if err != nil {
+		return "", authenticationError(err.Error() + " for " + params["username"])
+	}
+
+	expected := AuthInformation{
+		Wwwauth: DigestWWWAuthenticate{
+			Realm:     a.Realm,
+			Nonce:     params["nonce"],
+			Algorithm: algorithm,
+		},
+		Username: params["username"],
+		Password: credentials.Password,
+		HA1:      ha1,
+		Method:   request.Method,
+		URL:      params["uri"],
+		Qop:      params["qop"],
+		Cnonce:   params["cnonce"],
+		Body:     req.Body,
+	}
+	var nonceCount uint64
+	if expected.Qop != "" {
+		if expected.Qop != "auth" && expected.Qop != "auth-int" {
+			return "", authenticationError("Unsupported qop " + expected.Qop)
+		}
+		nonceCount, err = strconv.ParseUint(params["nc"], 16, 32)
+		if err != nil || nonceCount == 0 {
+			return "", authenticationError("Invalid nonce count " + params["nc"])
+		}
+		expected.NonceCount = uint32(nonceCount)
+	}
+	response := expected.FinalHash()
+	if subtle.ConstantTimeCompare([]byte(response), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", authenticationError("Wrong response for " + params["username"])
+	}
+	if err := a.useNonce(params["nonce"], nonceCount); err != nil {
+		return "", err
+	}
+	return params["username"], nil
+}
+
+// useNonce accepts nonceCount for nonce if the nonce was issued by us,
+// has not expired and the count is higher than any seen before. Without
+// qop, nonceCount is 0 and the nonce can only be used once.
+func (a *Authenticator) useNonce(nonce string, nonceCount uint64) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	issued, ok := a.issued(nonce)
+	if !ok || time.Since(issued) > a.NonceExpiry {
+		return errStaleNonce
+	}
+	state, ok := a.nonces[nonce]
+	if !ok {
+		if !issued.After(a.oldest) {
+			return errStaleNonce
+		}
+		state = &issuedNonce{issued: issued}
+		a.remember(nonce, state)
+	}
+	if nonceCount == 0 {
+		if state.nonceCount != 0 {
+			return errStaleNonce
+		}
+		state.nonceCount = ^uint64(0)
+		return nil
+	}
+	if nonceCount <= state.nonceCount {
+		return authenticationError(fmt.Sprintf("Replayed nonce count %08x", nonceCount))
+	}
+	state.nonceCount = nonceCount
+	return nil
+}
+
+// remember tracks the counts of nonce, dropping expired nonces and, if
+// the cache is full, the nonce used first.
+func (a *Authenticator) remember(nonce string, state *issuedNonce) {
+	if a.nonces == nil {
+		a.nonces = make(map[string]*issuedNonce)
+	}
+	for len(a.order) > 0 {
+		first := a.nonces[a.order[0]]
+		if len(a.order) < nonceCacheSize && time.Since(first.issued) <= a.NonceExpiry {
+			break
+		}
+		if first.issued.After(a.oldest) {
+			a.oldest = first.issued
+		}
+		delete(a.nonces, a.order[0])
+		a.order = a.order[1:]
+	}
+	a.nonces[nonce] = state
+	a.order = append(a.order, nonce)
+}
+
+// issued returns when nonce was issued, and false if it was not issued
+// by us.
+func (a *Authenticator) issued(nonce string) (time.Time, bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(b[8:], a.nonceMac(b[:8])) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b))), true
+}
+
+func (a *Authenticator) nonceMac(timestamp []byte) []byte {
+	if a.secret == nil {
+		a.secret = make([]byte, 32)
+		rand.Read(a.secret)
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(timestamp)
+	return mac.Sum(nil)
+}
+
+func (a *Authenticator) algorithm() string {
+	if a.Algorithm == "" {
+		return "MD5"
+	}
+	return a.Algorithm
+}
+
+// newNonce issues a nonce: the current time and its HMAC.
+func (a *Authenticator) newNonce() string {
+	timestamp := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return hex.EncodeToString(append(timestamp, a.nonceMac(timestamp)...))
+}
+
+func (a *Authenticator) challenge(req *Message, stale bool) *Message {
+	authenticateName, _ := a.headerNames()
+	code := 401
+	if a.Proxy {
+		code = 407
+	}
+	value := fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm=%s, qop="auth"`, a.Realm, a.newNonce(), a.algorithm())
+	if stale {
+		value += ", stale=true"
+	}
+	c := CreateResponseTo(req, code, ReasonPhrase(code))
+	c.AddHeader(authenticateName, value)
+	return &c
+}
@@ -0,0 +1,67 @@
+package sip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNonces(t *testing.T) {
+	a := NewAuthenticator("example.com", UserMap{})
+	nonce := a.newNonce()
+	if len(a.nonces) != 0 {
+		t.Fatal("issuing a nonce keeps state")
+	}
+	if err := a.useNonce(nonce, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.useNonce(nonce, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.useNonce(nonce, 2); err == nil || err == errStaleNonce {
+		t.Fatal("replayed nonce count accepted: ", err)
+	}
+
+	once := a.newNonce()
+	if err := a.useNonce(once, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.useNonce(once, 0); err != errStaleNonce {
+		t.Fatal("nonce without qop used twice: ", err)
+	}
+
+	forged := []byte(a.newNonce())
+	forged[len(forged)-1] ^= 1
+	if err := a.useNonce(string(forged), 1); err != errStaleNonce {
+		t.Fatal("forged nonce accepted: ", err)
+	}
+	if err := NewAuthenticator("example.com", UserMap{}).useNonce(a.newNonce(), 1); err != errStaleNonce {
+		t.Fatal("nonce of another authenticator accepted: ", err)
+	}
+
+	a.NonceExpiry = time.Nanosecond
+	expired := a.newNonce()
+	time.Sleep(time.Millisecond)
+	if err := a.useNonce(expired, 1); err != errStaleNonce {
+		t.Fatal("expired nonce accepted: ", err)
+	}
+}
+
+func TestNonceCacheBounded(t *testing.T) {
+	a := NewAuthenticator("example.com", UserMap{})
+	first := a.newNonce()
+	if err := a.useNonce(first, 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*nonceCacheSize; i++ {
+		if err := a.useNonce(a.newNonce(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(a.nonces) > nonceCacheSize || len(a.order) > nonceCacheSize {
+		t.Fatal("nonce cache grew to ", len(a.nonces))
+	}
+	// The count of first is forgotten, so it must not be accepted again.
+	if err := a.useNonce(first, 1); err != errStaleNonce {
+		t.Fatal("evicted nonce accepted: ", err)
+	}
+}
@@ -0,0 +1,365 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ---------------
+type ContentType struct {
+	MediaType string
+	Params    Params
+}
+
+func ParseContentType(value string) (ContentType, error) {
+	c := ContentType{}
+	elements := strings.SplitN(value, ";", 2)
+	mediaType := strings.ToLower(strings.TrimSpace(elements[0]))
+	typeSubtype := strings.Split(mediaType, "/")
+	if len(typeSubtype) != 2 || !isToken(typeSubtype[0]) || !isToken(typeSubtype[1]) {
+		return c, errors.New("Malformed Content-Type: " + value)
+	}
+	c.MediaType = mediaType
+	if len(elements) == 2 {
+		params, err := parseParams(elements[1], ";")
+		if err != nil {
+			return c, err
+		}
+		c.Params = params
+	}
+	return c, nil
+}
+
+func (c ContentType) Param(name string) string {
+	value, _ := c.Params.Get(name)
+	return unquote(value)
+}
+
+func (c ContentType) String() string {
+	return c.MediaType + c.Params.String()
+}
+
+// ---------------
+
+// MessageBody is a message body decoded according to its Content-Type.
+type MessageBody interface {
+	ContentType() ContentType
+	MarshalBody() ([]byte, error)
+}
+
+type BodyDecoder func(contentType ContentType, data []byte) (MessageBody, error)
+
+// bodyDecoders is guarded by bodyDecodersMutex, as decoders may be
+// registered while messages are decoded.
+var bodyDecodersMutex sync.RWMutex
+
+var bodyDecoders = map[string]BodyDecoder{
+	"application/sdp":       decodeSessionDescription,
+	"message/sipfrag":       decodeSipfrag,
+	"multipart/alternative": decodeMultipart,
+	"multipart/mixed":       decodeMultipart,
+	"multipart/related":     decodeMultipart,
+	"text/plain":            decodeText,
+}
+
+// RegisterBodyDecoder makes DecodeBody use decoder for bodies of the given
+// media type, e.g. "application/pidf+xml".
+func RegisterBodyDecoder(mediaType string, decoder BodyDecoder) {
+	bodyDecodersMutex.Lock()
+	defer bodyDecodersMutex.Unlock()
+	bodyDecoders[strings.ToLower(mediaType)] = decoder
+}
+
+func decodeBody(contentType ContentType, data []byte) (MessageBody, error) {
+	bodyDecodersMutex.RLock()
+	decoder, ok := bodyDecoders[contentType.MediaType]
+	bodyDecodersMutex.RUnlock()
+	if !ok {
+		return &RawBody{contentType, data}, nil
+	}
+	return decoder(contentType, data)
+}
+
+func (m *Message) GetContentType() (ContentType, error) {
+	header, err := m.Headers.FindHeaderByName("Content-Type")
+	if err != nil {
+		return ContentType{}, err
+	}
+	return ParseContentType(header.Value)
+}
+
+// DecodeBody decodes the body according to the Content-Type header.
+// Bodies of unknown type are returned as *RawBody, an empty body as nil.
+func (m *Message) DecodeBody() (MessageBody, error) {
+	if len(m.Body) == 0 {
+		return nil, nil
+	}
+	contentType, err := m.GetContentType()
+	if err != nil {
+		return nil, err
+	}
+	return decodeBody(contentType, m.Body)
+}
+
+// SetBody replaces the body and the Content-Type header.
+func (m *Message) SetBody(body MessageBody) error {
+	data, err := body.MarshalBody()
+	if err != nil {
+		return err
+	}
+	m.Body = data
+	m.Headers.ReplaceAddHeader("Content-Type", body.ContentType().String())
+	return nil
+}
+
+// ---------------
+
+type RawBody struct {
+	Type ContentType
+	Data []byte
+}
+
+func (r *RawBody) ContentType() ContentType {
+	return r.Type
+}
+
+func (r *RawBody) MarshalBody() ([]byte, error) {
+	return r.Data, nil
+}
+
+// ---------------
+
+type TextBody struct {
+	Text    string
+	Charset string
+}
+
+func decodeText(contentType ContentType, data []byte) (MessageBody, error) {
+	return &TextBody{string(data), contentType.Param("charset")}, nil
+}
+
+func (t *TextBody) ContentType() ContentType {
+	c := ContentType{MediaType: "text/plain"}
+	if t.Charset != "" {
+		c.Params.Set("charset", t.Charset)
+	}
+	return c
+}
+
+func (t *TextBody) MarshalBody() ([]byte, error) {
+	return []byte(t.Text), nil
+}
+
+// ---------------
+
+// SipfragBody is a message/sipfrag body (RFC 3420): a start line,
+// optionally followed by headers and a body.
+type SipfragBody struct {
+	Fragment Message
+}
+
+func decodeSipfrag(contentType ContentType, data []byte) (MessageBody, error) {
+	head, body, found := splitHeaderSection(data)
+	if !found {
+		head = data
+		body = nil
+	}
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("Empty sipfrag")
+	}
+	fragment, err := parseHeadline(lines[0])
+	if fragment == nil {
+		return nil, err
+	}
+	for _, line := range unfoldHeaderLines(lines[1:]) {
+		name, value, err := parseHeaderLine(line)
+		if err != nil {
+			return nil, err
+		}
+		fragment.Headers.AddHeader(name, value)
+	}
+	fragment.Body = body
+	return &SipfragBody{*fragment}, nil
+}
+
+func (s *SipfragBody) ContentType() ContentType {
+	return ContentType{MediaType: "message/sipfrag"}
+}
+
+func (s *SipfragBody) MarshalBody() ([]byte, error) {
+	if s.Fragment.Headline == nil {
+		return nil, errors.New("Sipfrag has no start line")
+	}
+	var b bytes.Buffer
+	b.WriteString(s.Fragment.Headline.ToString() + "\r\n")
+	for _, crtHeader := range s.Fragment.Headers.Lines {
+		b.WriteString(crtHeader.Name + ": " + crtHeader.Value + "\r\n")
+	}
+	if len(s.Fragment.Body) > 0 {
+		b.WriteString("\r\n")
+		b.Write(s.Fragment.Body)
+	}
+	return b.Bytes(), nil
+}
+
+// ---------------
+
+// MultipartBody is a multipart/* body (RFC 5621). An empty Boundary is
+// replaced by a random one when marshalling, so that ContentType has no
+// boundary before.
+type MultipartBody struct {
+	Subtype  string
+	Boundary string
+	Params   Params
+	Parts    []BodyPart
+}
+
+type BodyPart struct {
+	Headers Headers
+	Body    []byte
+}
+
+func decodeMultipart(contentType ContentType, data []byte) (MessageBody, error) {
+	boundary := contentType.Param("boundary")
+	if boundary == "" {
+		return nil, errors.New("Multipart body without boundary")
+	}
+	mp := &MultipartBody{
+		Subtype:  strings.TrimPrefix(contentType.MediaType, "multipart/"),
+		Boundary: boundary,
+	}
+	for _, param := range contentType.Params {
+		if !strings.EqualFold(param.Name, "boundary") {
+			mp.Params = append(mp.Params, param)
+		}
+	}
+
+	delimiter := []byte("--" + boundary)
+	// Normalize so that every delimiter is preceded by CRLF, even the
+	// first one if there is no preamble.
+	rest := append([]byte("\r\n"), data...)
+	start := bytes.Index(rest, append([]byte("\r\n"), delimiter...))
+	if start < 0 {
+		return nil, errors.New("Multipart body without delimiter")
+	}
+	rest = rest[start+2+len(delimiter):]
+	for {
+		if bytes.HasPrefix(rest, []byte("--")) {
+			return mp, nil
+		}
+		lineEnd := bytes.Index(rest, []byte("\r\n"))
+		if lineEnd < 0 {
+			return nil, errors.New("Malformed multipart delimiter line")
+		}
+		rest = rest[lineEnd+2:]
+
+		end := bytes.Index(rest, append([]byte("\r\n"), delimiter...))
+		if end < 0 {
+			return nil, errors.New("Unterminated multipart body")
+		}
+		part, err := parseBodyPart(rest[:end])
+		if err != nil {
+			return nil, err
+		}
+		mp.Parts = append(mp.Parts, part)
+		rest = rest[end+2+len(delimiter):]
+	}
+}
+
+func parseBodyPart(data []byte) (BodyPart, error) {
+	part := BodyPart{}
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		part.Body = data[2:]
+		return part, nil
+	}
+	head, body, found := splitHeaderSection(data)
+	if !found {
+		return part, errors.New("Body part without end of headers")
+	}
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	for _, line := range unfoldHeaderLines(lines) {
+		name, value, err := parseHeaderLine(line)
+		if err != nil {
+			return part, err
+		}
+		part.Headers.AddHeader(name, value)
+	}
+	part.Body = body
+	return part, nil
+}
+
+// NewBodyPart creates a part holding body along with its Content-Type.
+func NewBodyPart(body MessageBody) (BodyPart, error) {
+	part := BodyPart{}
+	data, err := body.MarshalBody()
+	if err != nil {
+		return part, err
+	}
+	part.Headers.AddHeader("Content-Type", body.ContentType().String())
+	part.Body = data
+	return part, nil
+}
+
+// Decode decodes the part according to its Content-Type, which defaults
+// to text/plain as in MIME.
+func (b *BodyPart) Decode() (MessageBody, error) {
+	contentType := ContentType{MediaType: "text/plain"}
+	if header, err := b.Headers.FindHeaderByName("Content-Type"); err == nil {
+		contentType, err = ParseContentType(header.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decodeBody(contentType, b.Body)
+}
+
+// NewMultipartBody creates a multipart/subtype body of parts with a
+// random boundary.
+func NewMultipartBody(subtype string, parts ...BodyPart) *MultipartBody {
+	return &MultipartBody{
+		Subtype:  subtype,
+		Boundary: RandSeq(24),
+		Parts:    parts,
+	}
+}
+
+func (mp *MultipartBody) ContentType() ContentType {
+	subtype := mp.Subtype
+	if subtype == "" {
+		subtype = "mixed"
+	}
+	c := ContentType{MediaType: "multipart/" + subtype}
+	c.Params = append(c.Params, mp.Params...)
+	switch {
+	case mp.Boundary == "":
+	case isToken(mp.Boundary):
+		c.Params.Set("boundary", mp.Boundary)
+	default:
+		c.Params.Set("boundary", quote(mp.Boundary))
+	}
+	return c
+}
+
+func (mp *MultipartBody) MarshalBody() ([]byte, error) {
+	if mp.Boundary == "" {
+		mp.Boundary = RandSeq(24)
+	}
+	var b bytes.Buffer
+	for _, part := range mp.Parts {
+		b.WriteString("--" + mp.Boundary + "\r\n")
+		for _, crtHeader := range part.Headers.Lines {
+			b.WriteString(crtHeader.Name + ": " + crtHeader.Value + "\r\n")
+		}
+		b.WriteString("\r\n")
+		b.Write(part.Body)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("--" + mp.Boundary + "--\r\n")
+	return b.Bytes(), nil
+}
@@ -0,0 +1,144 @@
+package sip
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const testSdp = "v=0\r\n" +
+	"o=alice 2890844526 2890844526 IN IP4 192.0.2.1\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.0.2.1\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 49170/2 RTP/AVP 0 8\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n" +
+	"m=video 51372 RTP/AVP 31\r\n"
+
+func TestSessionDescriptionRoundTrip(t *testing.T) {
+	sdp, err := ParseSessionDescription([]byte(testSdp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sdp.Media) != 2 {
+		t.Fatal(sdp.Media)
+	}
+	audio := sdp.Media[0]
+	if audio.Port != 49170 || audio.PortCount != 2 || len(audio.Formats) != 2 {
+		t.Fatal(audio)
+	}
+	if video := sdp.Media[1]; video.Port != 51372 || video.PortCount != 0 {
+		t.Fatal(video)
+	}
+	out, err := sdp.MarshalBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != testSdp {
+		t.Fatalf("Got\n%s\nexpected\n%s", out, testSdp)
+	}
+
+	for _, port := range []string{"49170/0", "49170/x", "x"} {
+		if _, err := parseSdpMedia("audio " + port + " RTP/AVP 0"); err == nil {
+			t.Errorf("Media port %s accepted", port)
+		}
+	}
+}
+
+func TestMultipartBody(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "rfc4475", "mpart01.sip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := m.DecodeBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := body.(*MultipartBody)
+	if len(mp.Parts) != 2 {
+		t.Fatal(len(mp.Parts))
+	}
+	first, err := mp.Parts[0].Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := first.(*SessionDescription).Connection(); c.Address != "192.0.2.4" {
+		t.Fatal(c)
+	}
+	if second, _ := mp.Parts[1].Decode(); second.(*TextBody).Text != "hello" {
+		t.Fatal(second)
+	}
+
+	// ContentType does not change the body, the boundary is generated
+	// when it is marshalled.
+	out := &MultipartBody{Parts: mp.Parts}
+	if contentType := out.ContentType(); out.Boundary != "" || contentType.Param("boundary") != "" {
+		t.Fatal("ContentType generated a boundary")
+	}
+	n := CreateRequest("MESSAGE", "sip:bob@example.com")
+	if err := n.SetBody(out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Boundary == "" {
+		t.Fatal("No boundary generated")
+	}
+	again, err := n.DecodeBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := again.(*MultipartBody).Parts
+	if len(parts) != 2 || string(parts[0].Body) != string(mp.Parts[0].Body) {
+		t.Fatal(parts)
+	}
+
+	if mp := NewMultipartBody("related", parts...); mp.Boundary == "" || mp.ContentType().Param("boundary") != mp.Boundary {
+		t.Fatal(mp.ContentType())
+	}
+}
+
+func TestSipfragBody(t *testing.T) {
+	fragment, err := decodeSipfrag(ContentType{}, []byte("SIP/2.0 180 Ringing\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := CreateRequest("NOTIFY", "sip:alice@example.com")
+	if err := n.SetBody(fragment); err != nil {
+		t.Fatal(err)
+	}
+	back, err := n.DecodeBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.(*SipfragBody).Fragment.Headline.ToString() != "SIP/2.0 180 Ringing" {
+		t.Fatal(back)
+	}
+}
+
+// TestRegisterBodyDecoderConcurrently is meant for the race detector.
+func TestRegisterBodyDecoderConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			RegisterBodyDecoder("application/x-test", func(contentType ContentType, data []byte) (MessageBody, error) {
+				return &RawBody{contentType, data}, nil
+			})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			decodeBody(ContentType{MediaType: "text/plain"}, []byte("hello"))
+		}
+	}()
+	wg.Wait()
+	bodyDecodersMutex.Lock()
+	delete(bodyDecoders, "application/x-test")
+	bodyDecodersMutex.Unlock()
+}
@@ -0,0 +1,139 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// inviteTimeout is how long an incoming INVITE can be cancelled while it
+// is not answered. After it, the INVITE is answered with 480.
+var inviteTimeout = 3 * time.Minute
+
+// serverInvite is an incoming INVITE which has no final response yet.
+// Its responses all carry the same To tag.
+type serverInvite struct {
+	request *Message
+	dialog  *Dialog
+	call    *Call
+	toTag   string
+}
+
+// serverTransactionKey identifies the server transaction of m, so that a
+// CANCEL finds the INVITE it cancels (RFC 3261, sections 9.2 and
+// 17.2.3): by the branch and sent-by of the top Via, or for requests
+// without an RFC 3261 branch by Call-ID, From tag, CSeq number and Via.
+func serverTransactionKey(m *Message) string {
+	vias, err := m.Vias()
+	if err != nil || len(vias) == 0 {
+		return ""
+	}
+	via := vias[0]
+	if strings.HasPrefix(via.Branch(), "z9hG4bK") {
+		return via.Branch() + " " + joinHostPort(via.Host, via.Port)
+	}
+	from, _ := m.FromAddress()
+	cseq, _ := m.GetCSeq()
+	return fmt.Sprintf("%s %s %d %s", m.GetCallId(), from.Tag(), cseq, via.String())
+}
+
+// response builds a response to req, the INVITE or its CANCEL, with the
+// To tag of the INVITE's responses.
+func (t *serverInvite) response(req *Message, code int) Message {
+	c := CreateResponseTo(req, code, ReasonPhrase(code))
+	if code > 100 {
+		if to, err := req.ToAddress(); err == nil && to.Tag() == "" {
+			to.Params = append(to.Params, Param{"tag", t.toTag})
+			c.SetToValue(to.String())
+		}
+	}
+	c.SetContentLength(0)
+	return c
+}
+
+func (t *serverInvite) respond(code int) {
+	c := t.response(t.request, code)
+	t.dialog.sendMessage(&c)
+}
+
+// acceptInvite keeps req, received on d, as pending until it is
+// cancelled or inviteTimeout passed, when it is answered with 480 as
+// nobody answered the call. It returns nil for a retransmission of a
+// pending INVITE.
+func (s *SipClient) acceptInvite(d *Dialog, req *Message) *serverInvite {
+	key := serverTransactionKey(req)
+	t := &serverInvite{
+		request: req,
+		dialog:  d,
+		call:    &Call{From: req.GetFrom()},
+		toTag:   RandSeq(10),
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.invites[key]; ok {
+		return nil
+	}
+	s.invites[key] = t
+	time.AfterFunc(inviteTimeout, func() {
+		s.mutex.Lock()
+		pending := s.invites[key] == t
+		if pending {
+			delete(s.invites, key)
+		}
+		s.mutex.Unlock()
+		if pending {
+			t.respond(480)
+		}
+	})
+	return t
+}
+
+// cancelInvite answers a CANCEL received on d. The INVITE it matches is
+// answered with 487, a CANCEL without a pending INVITE with 481 (RFC
+// 3261, section 9.2).
+func (s *SipClient) cancelInvite(d *Dialog, cancel *Message) {
+	key := serverTransactionKey(cancel)
+	s.mutex.Lock()
+	t, ok := s.invites[key]
+	delete(s.invites, key)
+	s.mutex.Unlock()
+	if !ok {
+		d.reject(cancel, 481)
+		return
+	}
+	c := t.response(cancel, 200)
+	d.sendMessage(&c)
+	t.respond(487)
+	if s.cancelCallback != nil {
+		s.cancelCallback(t.call)
+	}
+}
+
+// Cancel cancels invite, an INVITE waiting for its final response in
+// Request or SendAs. The CANCEL is sent on the same connection once a
+// provisional response was received (RFC 3261, section 9.1), and its
+// response is returned. The INVITE then usually fails with 487; if it
+// succeeds nonetheless, the call has to be ended with a BYE. invite is
+// only used to find the transaction, the CANCEL is built from the
+// INVITE as it was sent, e.g. with the CSeq of a retry after a challenge.
+func (s *SipClient) Cancel(ctx context.Context, invite *Message) (*Message, error) {
+	conn, t := s.Connections.pendingInvite(invite)
+	if conn == nil {
+		return nil, errors.New("No pending INVITE to cancel")
+	}
+	defer conn.release()
+
+	ctx, cancel := context.WithTimeout(ctx, TransactionTimeout)
+	defer cancel()
+	select {
+	case <-t.provisional:
+	case <-t.finished:
+		return nil, errors.New("INVITE already completed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	req := CreateCancel(t.request)
+	return conn.transact(ctx, &req, nil, 0)
+}
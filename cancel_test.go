@@ -0,0 +1,128 @@
+package sip
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestCancelAfterChallenge cancels an INVITE which was sent again with
+// credentials, while Request updates it.
+func TestCancelAfterChallenge(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cancels := make(chan *Message, 1)
+	invited := make(chan bool)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var invite *Message
+		send := func(m Message) {
+			b, _ := m.MarshalBinary()
+			conn.Write(b)
+		}
+		p := NewParser(conn)
+		p.SetCallback(func(m *Message) {
+			switch m.Headline.(RequestHeadline).Method {
+			case "INVITE":
+				if _, err := m.Headers.FindHeaderByName("Proxy-Authorization"); err != nil {
+					c := CreateResponseTo(m, 407, "Proxy Authentication Required")
+					c.AddHeader("Proxy-Authenticate", `Digest realm="example.com", nonce="abc", qop="auth"`)
+					send(c)
+					return
+				}
+				invite = m
+				close(invited)
+				send(CreateResponseTo(m, 180, "Ringing"))
+			case "CANCEL":
+				cancels <- m
+				send(CreateResponseTo(m, 200, "OK"))
+				send(CreateResponseTo(invite, 487, "Request Terminated"))
+			}
+		})
+		p.StartParsing()
+		<-p.Done()
+	}()
+
+	s := CreateClient()
+	defer s.Shutdown()
+	dest := Connectinfo{"tcp", "127.0.0.1", l.Addr().(*net.TCPAddr).Port}
+	info := &RegisterInfo{Registrar: dest, Client: Connectinfo{"tcp", "127.0.0.1", 5060}, Username: "alice", UserInfo: DigestUserInfo("alice", "secret")}
+	invite := info.NewRequest("INVITE", "sip:bob@example.com")
+
+	done := make(chan *Message, 1)
+	go func() {
+		response, err := s.Request(context.Background(), dest, &invite, info.UserInfo)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- response
+	}()
+	// Once the server has the INVITE with credentials, it is pending, and
+	// Cancel waits for the 180.
+	select {
+	case <-invited:
+	case final := <-done:
+		t.Fatal("INVITE completed before it was cancelled: ", final)
+	}
+	response, err := s.Cancel(context.Background(), &invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := response.Headline.(ResponseHeadline).Code; code != 200 {
+		t.Fatal("CANCEL answered with ", code)
+	}
+	final := <-done
+	if code := final.Headline.(ResponseHeadline).Code; code != 487 {
+		t.Fatal("INVITE answered with ", code)
+	}
+	cancel := <-cancels
+	if cseq, _ := cancel.GetCSeq(); cseq != 2 {
+		t.Fatal("CANCEL has the CSeq of the challenged INVITE: ", cseq)
+	}
+	if topBranch(cancel) != topBranch(&invite) {
+		t.Fatal("CANCEL has another branch than the INVITE")
+	}
+}
+
+func TestInviteTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { inviteTimeout = timeout }(inviteTimeout)
+	inviteTimeout = 50 * time.Millisecond
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	s := CreateClient()
+	d := CreateDialog(remote, &s)
+	defer remote.Close()
+	responses := make(chan *Message, 2)
+	p := NewParser(local)
+	p.SetCallback(func(m *Message) { responses <- m })
+	p.StartParsing()
+
+	info := &RegisterInfo{Registrar: Connectinfo{"tcp", "example.com", 5060}, Client: Connectinfo{"tcp", "127.0.0.1", 5060}, Username: "alice"}
+	invite := info.NewRequest("INVITE", "sip:bob@example.com")
+	if s.acceptInvite(d, &invite) == nil {
+		t.Fatal("INVITE taken for a retransmission")
+	}
+	select {
+	case m := <-responses:
+		if code := m.Headline.(ResponseHeadline).Code; code != 480 {
+			t.Fatal("Unanswered INVITE ended with ", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No final response to the unanswered INVITE")
+	}
+
+	cancel := CreateCancel(&invite)
+	go s.cancelInvite(d, &cancel)
+	if m := <-responses; m.Headline.(ResponseHeadline).Code != 481 {
+		t.Fatal("CANCEL after the timeout answered with ", m.Headline.ToString())
+	}
+}
@@ -0,0 +1,159 @@
+package sip
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+)
+
+// challengeCache remembers the digest challenges received from each
+// destination, per realm, so that later requests can be authorized
+// without being challenged again. Every use of a nonce increments its
+// nonce count.
+type challengeCache struct {
+	mutex   sync.Mutex
+	entries map[string]map[string]*cachedChallenge
+}
+
+type cachedChallenge struct {
+	challenge  DigestWWWAuthenticate
+	cnonce     string
+	nonceCount uint32
+}
+
+func newChallengeCache() *challengeCache {
+	return &challengeCache{
+		entries: make(map[string]map[string]*cachedChallenge),
+	}
+}
+
+func challengeKey(dest Connectinfo, userInfo UserInfo) string {
+	return userInfo.GetUsername() + " " + joinHostPort(dest.Host, dest.Port)
+}
+
+// challengesIn returns the supported digest challenges of a 401 or 407
+// response, keyed by header and realm. If several challenges are offered
+// for a realm, the one with the strongest algorithm is kept.
+func challengesIn(response *Message) map[string]DigestWWWAuthenticate {
+	challenges := make(map[string]DigestWWWAuthenticate)
+	for _, name := range []string{"WWW-Authenticate", "Proxy-Authenticate"} {
+		for _, line := range response.Headers.FindHeadersByName(name) {
+			auth, err := ParseWWWAuthenticate(line)
+			if err != nil {
+				log.Println("Error parsing ", name, ": ", err)
+				continue
+			}
+			digestAuth, ok := auth.(DigestWWWAuthenticate)
+			if !ok || digestAuth.Strength() == 0 {
+				continue
+			}
+			realm := name + " " + digestAuth.Realm
+			if known, seen := challenges[realm]; !seen || digestAuth.Strength() > known.Strength() {
+				challenges[realm] = digestAuth
+			}
+		}
+	}
+	return challenges
+}
+
+// isStale tells whether response rejected a request only because its
+// nonce had expired.
+func isStale(response *Message) bool {
+	for _, challenge := range challengesIn(response) {
+		if challenge.Stale {
+			return true
+		}
+	}
+	return false
+}
+
+// update stores the challenges of response, a 401 or 407 received from
+// dest.
+func (c *challengeCache) update(dest Connectinfo, response *Message, userInfo UserInfo) error {
+	if _, ok := userInfo.(CredentialProvider); !ok {
+		return errors.New("Authorization required but not provided")
+	}
+	challenges := challengesIn(response)
+	if len(challenges) == 0 {
+		return errors.New("Unsupported authentication challenge")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := challengeKey(dest, userInfo)
+	entries, ok := c.entries[key]
+	if !ok {
+		entries = make(map[string]*cachedChallenge)
+		c.entries[key] = entries
+	}
+	for realm, challenge := range challenges {
+		entries[realm] = &cachedChallenge{
+			challenge: challenge,
+			cnonce:    RandSeq(16),
+		}
+	}
+	return nil
+}
+
+// credentials returns the credentials for req, the next request to
+// dest, nil if no challenge is known. The credentials of each realm are
+// looked up with the CredentialProvider of userInfo.
+func (c *challengeCache) credentials(dest Connectinfo, userInfo UserInfo, req *Message) []AuthInformation {
+	provider, ok := userInfo.(CredentialProvider)
+	request, isRequest := req.Headline.(RequestHeadline)
+	if !ok || !isRequest {
+		return nil
+	}
+
+	c.mutex.Lock()
+	entries := c.entries[challengeKey(dest, userInfo)]
+	realms := make([]string, 0, len(entries))
+	for realm := range entries {
+		realms = append(realms, realm)
+	}
+	sort.Strings(realms)
+	challenges := make([]cachedChallenge, 0, len(realms))
+	for _, realm := range realms {
+		entries[realm].nonceCount++
+		challenges = append(challenges, *entries[realm])
+	}
+	c.mutex.Unlock()
+
+	var credentials []AuthInformation
+	for _, entry := range challenges {
+		secret, err := provider.Credentials(entry.challenge.Realm, request.Method, request.Uri.String())
+		if err != nil {
+			log.Println("No credentials for realm ", entry.challenge.Realm, ": ", err)
+			continue
+		}
+		ha1, err := secret.ha1For(entry.challenge.Algorithm)
+		if err != nil {
+			log.Println("No credentials for realm ", entry.challenge.Realm, ": ", err)
+			continue
+		}
+		if secret.Username == "" {
+			secret.Username = userInfo.GetUsername()
+		}
+		credentials = append(credentials, AuthInformation{
+			Wwwauth:    entry.challenge,
+			Username:   secret.Username,
+			Password:   secret.Password,
+			HA1:        ha1,
+			Cnonce:     entry.cnonce,
+			NonceCount: entry.nonceCount,
+		})
+	}
+	return credentials
+}
+
+// forget drops the challenges of dest, e.g. after the credentials were
+// rejected.
+func (c *challengeCache) forget(dest Connectinfo, userInfo UserInfo) {
+	if userInfo == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, challengeKey(dest, userInfo))
+}
@@ -0,0 +1,130 @@
+package sip
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// challengeResponse returns a 401 or 407 to req with the given
+// challenges.
+func challengeResponse(req *Message, code int, challenges ...string) *Message {
+	c := CreateResponseTo(req, code, ReasonPhrase(code))
+	name := "WWW-Authenticate"
+	if code == 407 {
+		name = "Proxy-Authenticate"
+	}
+	for _, challenge := range challenges {
+		c.AddHeader(name, challenge)
+	}
+	return &c
+}
+
+func challengedRequest() *Message {
+	info := &RegisterInfo{Registrar: Connectinfo{"udp", "example.com", 5060}, Client: Connectinfo{"udp", "192.0.2.1", 5060}, Username: "alice"}
+	req := (&Dialog{}).createRegister(info, false)
+	return &req
+}
+
+func TestChallengesIn(t *testing.T) {
+	req := challengedRequest()
+	m := challengeResponse(req, 401,
+		`Digest realm="a.example.com", nonce="1", algorithm=MD5`,
+		`Digest realm="a.example.com", nonce="2", algorithm=SHA-256`,
+		`Digest realm="a.example.com", nonce="3", algorithm=MD5-sess`,
+		`Digest realm="b.example.com", nonce="4"`,
+		`Digest realm="c.example.com", nonce="5", algorithm=UNKNOWN`)
+	challenges := challengesIn(m)
+	if len(challenges) != 2 {
+		t.Fatal(challenges)
+	}
+	if strongest := challenges["WWW-Authenticate a.example.com"]; strongest.Algorithm != "SHA-256" || strongest.Nonce != "2" {
+		t.Fatal("Strongest: ", strongest)
+	}
+	if challenge := challenges["WWW-Authenticate b.example.com"]; challenge.Nonce != "4" {
+		t.Fatal(challenge)
+	}
+	if isStale(m) {
+		t.Fatal("Stale without stale=true")
+	}
+	if !isStale(challengeResponse(req, 407, `Digest realm="a.example.com", nonce="6", stale=TRUE`)) {
+		t.Fatal("stale=TRUE not detected")
+	}
+}
+
+func TestChallengeNonceCount(t *testing.T) {
+	c := newChallengeCache()
+	dest := Connectinfo{"udp", "192.0.2.1", 5060}
+	userInfo := DigestUserInfo("alice", "secret")
+	req := challengedRequest()
+	if credentials := c.credentials(dest, userInfo, req); credentials != nil {
+		t.Fatal("Credentials without challenge: ", credentials)
+	}
+	if err := c.update(dest, challengeResponse(req, 401, `Digest realm="example.com", nonce="1", qop="auth"`), userInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every request reusing the nonce counts up, with the same cnonce.
+	var cnonce string
+	for _, nc := range []string{"nc=00000001", "nc=00000002"} {
+		credentials := c.credentials(dest, userInfo, req)
+		if len(credentials) != 1 {
+			t.Fatal(credentials)
+		}
+		if value := credentials[0].AuthorizationValue(); !strings.Contains(value, nc) {
+			t.Fatal("Expected ", nc, ": ", value)
+		}
+		if cnonce != "" && credentials[0].Cnonce != cnonce {
+			t.Fatal("cnonce changed")
+		}
+		cnonce = credentials[0].Cnonce
+	}
+
+	// A new nonce starts over.
+	if err := c.update(dest, challengeResponse(req, 401, `Digest realm="example.com", nonce="2", qop="auth", stale=true`), userInfo); err != nil {
+		t.Fatal(err)
+	}
+	credentials := c.credentials(dest, userInfo, req)
+	if len(credentials) != 1 || credentials[0].Wwwauth.Nonce != "2" || credentials[0].NonceCount != 1 {
+		t.Fatal(credentials)
+	}
+
+	c.forget(dest, userInfo)
+	if credentials := c.credentials(dest, userInfo, req); credentials != nil {
+		t.Fatal("Credentials after forget: ", credentials)
+	}
+	if err := c.update(dest, challengeResponse(req, 401, `Digest realm="example.com", nonce="3"`), UnauthorizedUserInfo("alice")); err == nil {
+		t.Fatal("Challenge accepted without credentials")
+	}
+}
+
+func TestStaleChallengeRetried(t *testing.T) {
+	var authorizations []string
+	port := startRegistrarPeer(t, func(req *Message) *Message {
+		header, err := req.Headers.FindHeaderByName("Authorization")
+		if err != nil {
+			return challengeResponse(req, 401, `Digest realm="example.com", nonce="1", qop="auth"`)
+		}
+		authorizations = append(authorizations, header.Value)
+		if strings.Contains(header.Value, `nonce="1"`) {
+			return challengeResponse(req, 401, `Digest realm="example.com", nonce="2", qop="auth", stale=true`)
+		}
+		c := CreateResponseTo(req, 200, "OK")
+		c.SetExpires(300)
+		return &c
+	})
+	s := CreateClient()
+	defer s.Shutdown()
+	info := &RegisterInfo{
+		Registrar: Connectinfo{"udp", "127.0.0.1", port},
+		Client:    Connectinfo{"udp", "127.0.0.1", 5060},
+		Username:  "alice",
+		UserInfo:  DigestUserInfo("alice", "secret"),
+	}
+	if _, err := s.Register(context.Background(), info); err != nil {
+		t.Fatal(err)
+	}
+	if len(authorizations) != 2 || !strings.Contains(authorizations[1], `nonce="2"`) || !strings.Contains(authorizations[1], "nc=00000001") {
+		t.Fatal("Authorized with ", authorizations)
+	}
+}
@@ -0,0 +1,420 @@
+package sip
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTimeout is how long a connection may stay unused before it
+// is closed.
+var DefaultIdleTimeout = 3 * time.Minute
+
+type connectionKey struct {
+	transport string
+	address   string
+}
+
+func newConnectionKey(transport string, host string, port int) connectionKey {
+	return connectionKey{strings.ToLower(transport), netAddress(host, port)}
+}
+
+// ConnectionManager keeps the connections of a SipClient by transport and
+// remote address, so that requests to a peer reuse the connection it is
+// already connected on, whoever opened it. Connections which are not in
+// use and carried no traffic for IdleTimeout are closed.
+type ConnectionManager struct {
+	IdleTimeout time.Duration
+
+	// Alias adds the alias parameter to the Via of requests sent on
+	// connections, offering the peer to reuse them for its requests to
+	// us (RFC 5923).
+	Alias bool
+
+	// AcceptAliases reuses a connection opened by a peer for requests to
+	// the sent-by of its Via, if that carries the alias parameter. The
+	// Via is not authenticated without TLS, so this is only safe with
+	// trusted peers.
+	AcceptAliases bool
+
+	mutex       sync.Mutex
+	connections map[connectionKey]*clientConnection
+	reaping     chan struct{}
+	// invites holds the INVITEs waiting for a final response by the
+	// message passed to transact, which Request may update meanwhile.
+	invites map[*Message]sentInvite
+}
+
+type sentInvite struct {
+	conn        *clientConnection
+	transaction *pendingTransaction
+}
+
+func NewConnectionManager() *ConnectionManager {
+	return &ConnectionManager{
+		IdleTimeout: DefaultIdleTimeout,
+		connections: make(map[connectionKey]*clientConnection),
+		invites:     make(map[*Message]sentInvite),
+	}
+}
+
+// clientConnection is a connection to a peer, opened by us or by the
+// peer. Responses are passed to the transaction waiting for them, requests
+// to the SipClient.
+type clientConnection struct {
+	dialog  *Dialog
+	key     connectionKey
+	manager *ConnectionManager
+	pongs   chan bool
+
+	mutex    sync.Mutex
+	pending  map[string]*pendingTransaction
+	users    int
+	lastUsed time.Time
+}
+
+func newClientConnection(s *SipClient, d *Dialog, key connectionKey) *clientConnection {
+	c := &clientConnection{
+		dialog:   d,
+		key:      key,
+		manager:  s.Connections,
+		pongs:    make(chan bool, 1),
+		pending:  make(map[string]*pendingTransaction),
+		lastUsed: time.Now(),
+	}
+	d.OnMessage(func(m *Message) {
+		c.touch()
+		if m.GetType() == REQUEST {
+			c.manager.learnAlias(c, m)
+			s.handleRequest(d, m)
+			return
+		}
+		c.deliver(m)
+	})
+	d.Parser.SetKeepaliveCallback(func(ping bool) {
+		c.touch()
+		if ping {
+			d.onKeepalive(ping)
+			return
+		}
+		select {
+		case c.pongs <- true:
+		default:
+		}
+	})
+	go func() {
+		<-c.closed()
+		c.manager.remove(c)
+	}()
+	return c
+}
+
+// get returns an open connection to dest, dialing one if there is none.
+// It must be released after use.
+func (m *ConnectionManager) get(ctx context.Context, s *SipClient, dest Connectinfo) (*clientConnection, error) {
+	key := newConnectionKey(dest.Transport, dest.Host, dest.Port)
+	if c := m.lookup(key); c != nil {
+		return c, nil
+	}
+
+	var dialer net.Dialer
+	socket, err := dialer.DialContext(ctx, dest.Transport, key.address)
+	if err != nil {
+		return nil, err
+	}
+	if key.transport == "udp" {
+		socket = newStunConn(socket)
+	}
+	c := newClientConnection(s, CreateDialog(socket, s), key)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if existing, ok := m.connections[key]; ok && existing.isOpen() {
+		// Connected concurrently, use the first connection.
+		c.close()
+		existing.acquire()
+		return existing, nil
+	}
+	m.add(c)
+	c.acquire()
+	return c, nil
+}
+
+func (m *ConnectionManager) lookup(key connectionKey) *clientConnection {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c, ok := m.connections[key]
+	if !ok || !c.isOpen() {
+		return nil
+	}
+	c.acquire()
+	return c
+}
+
+// adopt manages a connection accepted from a peer.
+func (m *ConnectionManager) adopt(s *SipClient, d *Dialog, transport string) *clientConnection {
+	key := connectionKey{strings.ToLower(transport), d.Conn.RemoteAddr().String()}
+	c := newClientConnection(s, d, key)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.add(c)
+	return c
+}
+
+func (m *ConnectionManager) add(c *clientConnection) {
+	if m.connections == nil {
+		m.connections = make(map[connectionKey]*clientConnection)
+	}
+	m.connections[c.key] = c
+	if m.reaping == nil && m.IdleTimeout > 0 {
+		m.reaping = make(chan struct{})
+		go m.reap(m.reaping, m.IdleTimeout)
+	}
+}
+
+func (m *ConnectionManager) remove(c *clientConnection) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for key, crt := range m.connections {
+		if crt == c {
+			delete(m.connections, key)
+		}
+	}
+}
+
+// learnAlias registers c for the sent-by of req if its Via carries the
+// alias parameter and aliases are accepted (RFC 5923, section 5).
+func (m *ConnectionManager) learnAlias(c *clientConnection, req *Message) {
+	if !m.AcceptAliases {
+		return
+	}
+	vias, err := req.Vias()
+	if err != nil || len(vias) == 0 || !vias[0].Params.Has("alias") {
+		return
+	}
+	port := vias[0].Port
+	if port == 0 {
+		port = 5060
+	}
+	key := newConnectionKey(c.key.transport, vias[0].Host, port)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if existing, ok := m.connections[key]; !ok || !existing.isOpen() {
+		m.connections[key] = c
+	}
+}
+
+// reap closes idle connections until CloseAll is called.
+func (m *ConnectionManager) reap(stop chan struct{}, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		m.mutex.Lock()
+		var idle []*clientConnection
+		for _, c := range m.connections {
+			if c.isIdle(timeout) {
+				idle = append(idle, c)
+			}
+		}
+		m.mutex.Unlock()
+		for _, c := range idle {
+			log.Println("Closing idle connection to ", c.key.address)
+			c.close()
+		}
+	}
+}
+
+// CloseAll closes all connections, e.g. on shutdown.
+func (m *ConnectionManager) CloseAll() {
+	m.mutex.Lock()
+	var all []*clientConnection
+	for _, c := range m.connections {
+		all = append(all, c)
+	}
+	m.connections = make(map[connectionKey]*clientConnection)
+	if m.reaping != nil {
+		close(m.reaping)
+		m.reaping = nil
+	}
+	m.mutex.Unlock()
+	for _, c := range all {
+		c.close()
+	}
+}
+
+// pendingInvite returns the connection on which invite is waiting for
+// its final response, and its transaction. The connection must be
+// released after use.
+func (m *ConnectionManager) pendingInvite(invite *Message) (*clientConnection, *pendingTransaction) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sent, ok := m.invites[invite]
+	if !ok {
+		return nil, nil
+	}
+	sent.conn.acquire()
+	return sent.conn, sent.transaction
+}
+
+// Count returns the number of open connections.
+func (m *ConnectionManager) Count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seen := make(map[*clientConnection]bool)
+	for _, c := range m.connections {
+		seen[c] = true
+	}
+	return len(seen)
+}
+
+func (c *clientConnection) acquire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.users++
+	c.lastUsed = time.Now()
+}
+
+// release ends a use of c. It stays open for reuse until it is idle.
+func (c *clientConnection) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.users > 0 {
+		c.users--
+	}
+	c.lastUsed = time.Now()
+}
+
+func (c *clientConnection) touch() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastUsed = time.Now()
+}
+
+func (c *clientConnection) isIdle(timeout time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.users == 0 && time.Since(c.lastUsed) > timeout
+}
+
+func (c *clientConnection) isOpen() bool {
+	select {
+	case <-c.closed():
+		return false
+	default:
+		return true
+	}
+}
+
+// close closes the connection for all its users, e.g. after a failure.
+func (c *clientConnection) close() {
+	c.dialog.Conn.Close()
+}
+
+// closed is closed once the connection is no longer read, e.g. because
+// the peer closed it.
+func (c *clientConnection) closed() <-chan struct{} {
+	return c.dialog.Parser.Done()
+}
+
+// pendingTransaction is a client transaction waiting for responses.
+// provisional is closed on the first provisional response, finished once
+// the transaction is forgotten. request is a copy of an INVITE as sent,
+// to build its CANCEL from.
+type pendingTransaction struct {
+	request     *Message
+	responses   chan *Message
+	provisional chan struct{}
+	finished    chan struct{}
+}
+
+func transactionKey(m *Message) string {
+	_, method := m.GetCSeq()
+	return topBranch(m) + " " + method
+}
+
+// await returns the channel receiving the responses to req, until
+// forget is called.
+func (c *clientConnection) await(req *Message) chan *Message {
+	t := &pendingTransaction{
+		responses:   make(chan *Message, 16),
+		provisional: make(chan struct{}),
+		finished:    make(chan struct{}),
+	}
+	invite := req.Headline.(RequestHeadline).Method == "INVITE"
+	if invite {
+		sent := req.Clone()
+		t.request = &sent
+	}
+	c.mutex.Lock()
+	c.pending[transactionKey(req)] = t
+	c.mutex.Unlock()
+
+	if invite {
+		c.manager.mutex.Lock()
+		c.manager.invites[req] = sentInvite{c, t}
+		c.manager.mutex.Unlock()
+	}
+	return t.responses
+}
+
+func (c *clientConnection) forget(req *Message) {
+	c.mutex.Lock()
+	key := transactionKey(req)
+	t, ok := c.pending[key]
+	if ok {
+		close(t.finished)
+		delete(c.pending, key)
+	}
+	c.mutex.Unlock()
+
+	if ok && t.request != nil {
+		c.manager.mutex.Lock()
+		if c.manager.invites[req].transaction == t {
+			delete(c.manager.invites, req)
+		}
+		c.manager.mutex.Unlock()
+	}
+}
+
+func (c *clientConnection) deliver(m *Message) {
+	c.mutex.Lock()
+	t, ok := c.pending[transactionKey(m)]
+	if response := m.Headline.(ResponseHeadline); ok && !response.IsFinal() {
+		select {
+		case <-t.provisional:
+		default:
+			close(t.provisional)
+		}
+	}
+	c.mutex.Unlock()
+	if !ok {
+		if s := c.dialog.client; s != nil && s.Proxy != nil {
+			s.Proxy.relayResponse(m)
+			return
+		}
+		log.Println("Dropping response without transaction: ", m.Headline.ToString())
+		return
+	}
+	select {
+	case t.responses <- m:
+	default:
+		log.Println("Dropping response, too many pending: ", m.Headline.ToString())
+	}
+}
+
+// send sends m, adding the alias parameter to the Via of requests if
+// enabled.
+func (c *clientConnection) send(m *Message) {
+	if c.manager.Alias && m.GetType() == REQUEST && c.key.transport != "udp" {
+		m.SetTopViaParam("alias", "")
+	}
+	c.dialog.sendMessage(m)
+}
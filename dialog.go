@@ -1,6 +1,7 @@
 package sip
 
 import (
+	"log"
 	"net"
 )
 
@@ -38,6 +39,11 @@ func CreateDialog(socket net.Conn, sipClient *SipClient) *Dialog {
 	d.Local = ""
 	d.viaBranch = RandSeq(10)
 	d.Parser = NewParser(d.Conn)
+	if sipClient != nil {
+		d.Parser.SetLimits(sipClient.Limits)
+	}
+	d.Parser.SetErrorCallback(d.onParseError)
+	d.Parser.SetKeepaliveCallback(d.onKeepalive)
 	d.Parser.StartParsing()
 	d.client = sipClient
 	return &d
@@ -58,8 +64,41 @@ func (d *Dialog) OnMessage(callback Callback) {
 	})
 }
 
+func (d *Dialog) onParseError(err error) {
+	log.Println("Error parsing message: ", err)
+	switch e := err.(type) {
+	case *ParseError:
+		d.reject(e.Message, e.Code)
+	case *LimitError:
+		d.reject(e.Message, e.Code)
+		d.Conn.Close()
+	}
+}
+
+// onKeepalive answers a double-CRLF ping with a CRLF pong.
+func (d *Dialog) onKeepalive(ping bool) {
+	if ping {
+		d.Conn.Write([]byte("\r\n"))
+	}
+}
+
+// reject answers a request which could not be processed. Responses and
+// messages without a usable status code are dropped.
+func (d *Dialog) reject(m *Message, code int) {
+	if code == 0 || m == nil || m.GetType() != REQUEST || len(m.Headers.FindHeadersByName("Via")) == 0 {
+		return
+	}
+	c := CreateResponseTo(m, code, ReasonPhrase(code))
+	d.sendMessage(&c)
+}
+
 func (d *Dialog) sendMessage(m *Message) {
-	d.Conn.Write([]byte(m.String()))
+	data, err := m.MarshalBinary()
+	if err != nil {
+		log.Println("Error marshalling message: ", err)
+		return
+	}
+	d.Conn.Write(data)
 }
 
 func (d *Dialog) Reply100Trying() {
@@ -84,6 +123,9 @@ func (d *Dialog) Reply180Ringing() {
 
 	c := CreateResponse(180, "Ringing")
 	c.SetViaValue(d.via)
+	for _, recordRoute := range d.lastRequest.Headers.FindHeadersByName("Record-Route") {
+		c.Headers.AddHeader("Record-Route", recordRoute.Value)
+	}
 	c.SetFromValue(from)
 	c.SetToValue(to)
 	c.SetCallId(d.CallID)
@@ -100,6 +142,9 @@ func (d *Dialog) Reply200Ok() {
 
 	c := CreateResponse(200, "OK")
 	c.SetViaValue(d.via)
+	for _, recordRoute := range d.lastRequest.Headers.FindHeadersByName("Record-Route") {
+		c.Headers.AddHeader("Record-Route", recordRoute.Value)
+	}
 	c.SetFromValue(from)
 	c.SetToValue(to)
 	c.SetCallId(d.CallID)
@@ -111,55 +156,35 @@ func (d *Dialog) Reply200Ok() {
 }
 
 func (d *Dialog) SendRegister(registerInfo *RegisterInfo, authInfo *AuthInformation) {
-	d.client.registerInfo = registerInfo
-	clientCI := registerInfo.Client
-	registrarCI := registerInfo.Registrar
-	userName := registerInfo.Username
-
-	c := CreateRequest("REGISTER", "sip:"+registerInfo.Registrar.Host)
-
-	d.CallID = RandSeq(10)
-	crtCSeq := d.cseq()
-
-	c.SetVia(clientCI.Transport, clientCI.Host, clientCI.Port, d.viaBranch)
-	if d.Local == "" {
-		fromTag := RandSeq(10)
-		c.SetFrom("sip", userName, registrarCI.Host, fromTag)
-		d.Local = c.GetFrom()
-	} else {
-		c.SetFromValue(d.Local)
+	c := d.createRegister(registerInfo, false)
+	if authInfo != nil {
+		c.SetDigestAuthorizationHeader(*authInfo)
 	}
+	d.sendMessage(&c)
+}
 
-	if d.Remote == "" {
-		c.SetTo("sip", userName, registrarCI.Host, "")
-		d.Remote = c.GetTo()
-	} else {
-		c.SetToValue(d.Remote)
-	}
-	c.SetCallId(d.CallID)
-	c.SetCSeq(crtCSeq, "REGISTER")
-	c.SetContact("sip", userName, clientCI.Host, clientCI.Port)
-	c.SetExpires(300)
+func (d *Dialog) SendDeregister(registerInfo *RegisterInfo, authInfo *AuthInformation) {
+	c := d.createRegister(registerInfo, true)
 	if authInfo != nil {
 		c.SetDigestAuthorizationHeader(*authInfo)
 	}
-	c.SetUserAgent("sipbell/0.1")
-	c.SetAllow([]string{"PRACK", "INVITE", "ACK", "BYE", "CANCEL", "UPDATE", "INFO", "SUBSCRIBE", "NOTIFY", "OPTIONS", "REFER", "MESSAGE"})
-	c.SetContentLength(0)
-
 	d.sendMessage(&c)
 }
 
-func (d *Dialog) SendDeregister(registerInfo *RegisterInfo, authInfo *AuthInformation) {
-	d.client.registerInfo = registerInfo
+// createRegister builds the next REGISTER of this dialog. Every request
+// gets a new branch and CSeq, Call-ID and From stay the same.
+func (d *Dialog) createRegister(registerInfo *RegisterInfo, unregister bool) Message {
 	clientCI := registerInfo.Client
 	registrarCI := registerInfo.Registrar
 	userName := registerInfo.Username
 
-	c := CreateRequest("REGISTER", "sip:"+registerInfo.Registrar.Host)
+	c := CreateRequest("REGISTER", "sip:"+joinHostPort(registerInfo.Registrar.Host, 0))
 
-	d.CallID = RandSeq(10)
+	if d.CallID == "" {
+		d.CallID = RandSeq(10)
+	}
 	crtCSeq := d.cseq()
+	d.viaBranch = RandSeq(10)
 
 	c.SetVia(clientCI.Transport, clientCI.Host, clientCI.Port, d.viaBranch)
 	if d.Local == "" {
@@ -169,23 +194,29 @@ func (d *Dialog) SendDeregister(registerInfo *RegisterInfo, authInfo *AuthInform
 	} else {
 		c.SetFromValue(d.Local)
 	}
-
-	if d.Remote == "" {
-		c.SetTo("sip", userName, registrarCI.Host, "")
-		d.Remote = c.GetTo()
-	} else {
-		c.SetToValue(d.Remote)
-	}
+	c.SetTo("sip", userName, registrarCI.Host, "")
 	c.SetCallId(d.CallID)
 	c.SetCSeq(crtCSeq, "REGISTER")
-	c.SetContactValue("*")
-	c.SetExpires(0)
-	if authInfo != nil {
-		c.SetDigestAuthorizationHeader(*authInfo)
+	// Unregistering removes only our own binding, not the other
+	// bindings of the address-of-record (RFC 3261, section 10.2.2).
+	c.SetContact("sip", userName, clientCI.Host, clientCI.Port)
+	contacts, _ := c.Contacts()
+	contact := contacts[0]
+	if registerInfo.usesOutbound() {
+		contact.Params = append(contact.Params, registerInfo.outboundContactParams()...)
+		c.AddHeader("Supported", "outbound, path")
+	}
+	if unregister {
+		contact.Params = append(contact.Params, Param{"expires", "0"})
+		c.SetExpires(0)
+	} else {
+		c.SetExpires(registerInfo.RequestedExpiration())
 	}
+	c.SetContactValue(contact.String())
 	c.SetUserAgent("sipbell/0.1")
-	c.SetAllow([]string{"PRACK", "INVITE", "ACK", "BYE", "CANCEL", "UPDATE", "INFO", "SUBSCRIBE", "NOTIFY", "OPTIONS", "REFER", "MESSAGE"})
+	if d.client != nil {
+		c.SetAllow(d.client.allowedMethods())
+	}
 	c.SetContentLength(0)
-
-	d.sendMessage(&c)
+	return c
 }
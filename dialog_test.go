@@ -0,0 +1,61 @@
+package sip
+
+import "testing"
+
+func TestUnregisterKeepsOtherBindings(t *testing.T) {
+	registrar := NewRegistrar(NewMemoryLocationStore())
+	phone := &RegisterInfo{
+		Registrar:  Connectinfo{"tcp", "example.com", 5060},
+		Client:     Connectinfo{"tcp", "192.0.2.1", 5060},
+		Username:   "alice",
+		InstanceID: "urn:uuid:00000000-0000-1000-8000-000a95a0e128",
+		RegID:      1,
+	}
+	desk := &RegisterInfo{
+		Registrar: phone.Registrar,
+		Client:    Connectinfo{"tcp", "192.0.2.2", 5060},
+		Username:  "alice",
+	}
+	for _, info := range []*RegisterInfo{phone, desk} {
+		req := (&Dialog{CSeq: 1}).createRegister(info, false)
+		if code := registrar.HandleRegister(&req).Headline.(ResponseHeadline).Code; code != 200 {
+			t.Fatal("REGISTER answered with ", code)
+		}
+	}
+
+	req := (&Dialog{CSeq: 2}).createRegister(phone, true)
+	contacts, err := req.Contacts()
+	if err != nil || len(contacts) != 1 || !phone.isOwnContact(contacts[0]) {
+		t.Fatal("Unregistering with Contact ", contacts, err)
+	}
+	for _, param := range []string{"expires", "reg-id", "+sip.instance"} {
+		if _, ok := contacts[0].Params.Get(param); !ok {
+			t.Error("Contact without ", param, ": ", contacts[0].String())
+		}
+	}
+	if code := registrar.HandleRegister(&req).Headline.(ResponseHeadline).Code; code != 200 {
+		t.Fatal("Unregistering answered with ", code)
+	}
+	bindings, err := registrar.Store.Lookup("sip:alice@example.com")
+	if err != nil || len(bindings) != 1 || !desk.isOwnContact(bindings[0].Contact) {
+		t.Fatal("Remaining bindings: ", bindings, err)
+	}
+}
+
+func TestRegisterAllow(t *testing.T) {
+	s := CreateClient()
+	info := &RegisterInfo{
+		Registrar: Connectinfo{"tcp", "example.com", 5060},
+		Client:    Connectinfo{"tcp", "192.0.2.1", 5060},
+		Username:  "alice",
+	}
+	d := &Dialog{client: &s}
+	req := d.createRegister(info, false)
+	allow, err := req.Headers.FindHeaderByName("Allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allow.Value != "INVITE, ACK, CANCEL, OPTIONS" {
+		t.Fatal("Allow: ", allow.Value)
+	}
+}
@@ -0,0 +1,238 @@
+package sip
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeNAPTR    = 35
+	dnsClassIN      = 1
+	dnsQueryTimeout = 3 * time.Second
+)
+
+// queryNAPTR asks the name server at server for the NAPTR records of
+// name. The standard library has no NAPTR lookup, so the query is built
+// by hand (RFC 1035, section 4 and RFC 3403, section 4). A name without
+// records gives no error.
+func queryNAPTR(ctx context.Context, server string, name string) ([]NAPTR, error) {
+	query, id, err := newDNSQuery(name, dnsTypeNAPTR)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+
+	response, err := exchangeDNS(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	records, truncated, err := parseNAPTRResponse(response, id)
+	if err != nil || !truncated {
+		return records, err
+	}
+	response, err = exchangeDNS(ctx, "tcp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	records, _, err = parseNAPTRResponse(response, id)
+	return records, err
+}
+
+func newDNSQuery(name string, qtype uint16) ([]byte, uint16, error) {
+	b := make([]byte, 2)
+	rand.Read(b)
+	id := binary.BigEndian.Uint16(b)
+
+	// Header: id, recursion desired, one question.
+	query := []byte{b[0], b[1], 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, errors.New("Invalid domain name " + name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	query = binary.BigEndian.AppendUint16(query, dnsClassIN)
+	return query, id, nil
+}
+
+func exchangeDNS(ctx context.Context, network string, server string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(framed, query...)); err != nil {
+			return nil, err
+		}
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		response := make([]byte, binary.BigEndian.Uint16(length))
+		_, err := io.ReadFull(conn, response)
+		return response, err
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 65535)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return response[:n], nil
+}
+
+// parseNAPTRResponse returns the NAPTR records of a response to the query
+// with id, and whether it was truncated.
+func parseNAPTRResponse(msg []byte, id uint16) ([]NAPTR, bool, error) {
+	if len(msg) < 12 {
+		return nil, false, errors.New("DNS response too short")
+	}
+	if binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return nil, false, errors.New("Unexpected DNS response")
+	}
+	truncated := msg[2]&0x02 != 0
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		// NXDOMAIN
+		return nil, truncated, nil
+	default:
+		return nil, truncated, errors.New("DNS query failed with rcode " + strconv.Itoa(int(rcode)))
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		var err error
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, truncated, err
+		}
+		off += 4
+	}
+
+	var records []NAPTR
+	for i := 0; i < answers; i++ {
+		var err error
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, truncated, err
+		}
+		if off+10 > len(msg) {
+			return nil, truncated, errors.New("DNS response too short")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, truncated, errors.New("DNS response too short")
+		}
+		if rtype == dnsTypeNAPTR {
+			record, err := parseNAPTR(msg, off, off+length)
+			if err != nil {
+				return nil, truncated, err
+			}
+			records = append(records, record)
+		}
+		off += length
+	}
+	return records, truncated, nil
+}
+
+func parseNAPTR(msg []byte, off int, end int) (NAPTR, error) {
+	if off+4 > end {
+		return NAPTR{}, errors.New("Invalid NAPTR record")
+	}
+	record := NAPTR{
+		Order:      binary.BigEndian.Uint16(msg[off:]),
+		Preference: binary.BigEndian.Uint16(msg[off+2:]),
+	}
+	off += 4
+	for _, field := range []*string{&record.Flags, &record.Service, &record.Regexp} {
+		if off >= end || off+1+int(msg[off]) > end {
+			return NAPTR{}, errors.New("Invalid NAPTR record")
+		}
+		*field = string(msg[off+1 : off+1+int(msg[off])])
+		off += 1 + int(msg[off])
+	}
+	replacement, _, err := readDNSName(msg, off)
+	if err != nil {
+		return NAPTR{}, err
+	}
+	record.Replacement = replacement
+	return record, nil
+}
+
+// readDNSName reads the possibly compressed domain name at off. It
+// returns the name, with a trailing dot, and the offset after it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("Invalid domain name in DNS response")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errors.New("Invalid domain name in DNS response")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errors.New("Invalid domain name in DNS response")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// systemNameServer returns the first name server of /etc/resolv.conf.
+func systemNameServer() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
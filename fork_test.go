@@ -0,0 +1,291 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// branchPeer is a user agent a forking proxy forwards to. It passes
+// each INVITE to onInvite and answers a CANCEL with 200 and 487 to the
+// INVITE.
+type branchPeer struct {
+	port    int
+	methods chan string
+
+	mutex  sync.Mutex
+	conn   net.Conn
+	invite *Message
+}
+
+func startBranchPeer(t *testing.T, onInvite func(p *branchPeer, invite *Message)) *branchPeer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p := &branchPeer{port: l.Addr().(*net.TCPAddr).Port, methods: make(chan string, 16)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			parser := NewParser(conn)
+			parser.SetCallback(func(m *Message) {
+				method := m.Headline.(RequestHeadline).Method
+				p.mutex.Lock()
+				p.conn = conn
+				if method == "INVITE" {
+					p.invite = m
+				}
+				p.mutex.Unlock()
+				p.methods <- method
+				switch method {
+				case "INVITE":
+					onInvite(p, m)
+				case "CANCEL":
+					p.respond(m, 200)
+					p.respond(p.invite, 487)
+				}
+			})
+			parser.StartParsing()
+		}
+	}()
+	return p
+}
+
+func (p *branchPeer) send(m *Message) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	data, _ := m.MarshalBinary()
+	p.conn.Write(data)
+}
+
+func (p *branchPeer) respond(req *Message, code int) {
+	c := CreateResponseTo(req, code, ReasonPhrase(code))
+	p.send(&c)
+}
+
+// answering returns an onInvite which rings and answers with code.
+func answering(code int) func(p *branchPeer, invite *Message) {
+	return func(p *branchPeer, invite *Message) {
+		p.respond(invite, 180)
+		p.respond(invite, code)
+	}
+}
+
+func ringing(p *branchPeer, invite *Message) {
+	p.respond(invite, 180)
+}
+
+// expectMethods waits for the requests p receives.
+func (p *branchPeer) expectMethods(t *testing.T, methods ...string) {
+	t.Helper()
+	for _, method := range methods {
+		select {
+		case got := <-p.methods:
+			if got != method {
+				t.Fatalf("Got %s, expected %s", got, method)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No %s received", method)
+		}
+	}
+}
+
+func (p *branchPeer) binding(q float64) Binding {
+	return Binding{
+		Contact: Address{Uri: ParseSipUri(fmt.Sprintf("sip:bob@127.0.0.1:%d", p.port))},
+		Expires: time.Now().Add(time.Hour),
+		Q:       q,
+	}
+}
+
+// startForkingProxy starts a stateful proxy for example.com which
+// forwards to the bindings of store, and returns a connection to it.
+func startForkingProxy(t *testing.T, forking ForkMode, store LocationStore) *clientConnection {
+	px := CreateClient()
+	t.Cleanup(px.Shutdown)
+	if err := px.Listen("tcp", "127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	var port int
+	for _, l := range px.Listeners {
+		port = l.listener.Addr().(*net.TCPAddr).Port
+	}
+	px.Proxy = NewProxy(&px, "127.0.0.1", port)
+	px.Proxy.Domains = []string{"example.com"}
+	px.Proxy.Locations = store
+	px.Proxy.Forking = forking
+
+	s := CreateClient()
+	t.Cleanup(s.Shutdown)
+	conn, err := s.dial(context.Background(), Connectinfo{"tcp", "127.0.0.1", port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.release)
+	return conn
+}
+
+func inviteThrough(t *testing.T, conn *clientConnection) *Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := conn.transact(ctx, proxyRequest("INVITE", "sip:bob@example.com"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestForkGroups(t *testing.T) {
+	targets := []Target{
+		{ParseSipUri("sip:a@192.0.2.1"), 0.5},
+		{ParseSipUri("sip:b@192.0.2.2"), 1},
+		{ParseSipUri("sip:c@192.0.2.3"), 0.5},
+	}
+	p := &Proxy{}
+	if groups := p.forkGroups(targets); len(groups) != 1 || len(groups[0]) != 3 {
+		t.Fatal("Parallel: ", groups)
+	}
+	p.Forking = SEQUENTIAL
+	groups := p.forkGroups(targets)
+	if len(groups) != 2 || len(groups[0]) != 1 || groups[0][0].Uri.User != "b" || len(groups[1]) != 2 {
+		t.Fatal("Sequential: ", groups)
+	}
+	if groups[1][0].Uri.User != "a" || groups[1][1].Uri.User != "c" {
+		t.Fatal("Order within the group changed: ", groups[1])
+	}
+}
+
+func TestForkParallelCancels(t *testing.T) {
+	for _, code := range []int{200, 603} {
+		store := NewMemoryLocationStore()
+		conn := startForkingProxy(t, PARALLEL, store)
+		answered := make(chan bool)
+		answerer := startBranchPeer(t, func(p *branchPeer, invite *Message) {
+			// Answer once the other branch rings, as both are tried at
+			// once.
+			<-answered
+			answering(code)(p, invite)
+		})
+		ringer := startBranchPeer(t, func(p *branchPeer, invite *Message) {
+			ringing(p, invite)
+			close(answered)
+		})
+		store.Store("sip:bob@example.com", []Binding{answerer.binding(1), ringer.binding(1)})
+
+		if m := inviteThrough(t, conn); responseCode(m) != code {
+			t.Fatal(m.String())
+		}
+		ringer.expectMethods(t, "INVITE", "CANCEL")
+	}
+}
+
+func TestForkDefersCancel(t *testing.T) {
+	store := NewMemoryLocationStore()
+	conn := startForkingProxy(t, PARALLEL, store)
+	silent := startBranchPeer(t, func(p *branchPeer, invite *Message) {})
+	answerer := startBranchPeer(t, func(p *branchPeer, invite *Message) {
+		<-silent.methods
+		answering(200)(p, invite)
+	})
+	store.Store("sip:bob@example.com", []Binding{answerer.binding(1), silent.binding(1)})
+
+	if m := inviteThrough(t, conn); responseCode(m) != 200 {
+		t.Fatal(m.String())
+	}
+	// The CANCEL must not overtake the INVITE before it is answered.
+	select {
+	case method := <-silent.methods:
+		t.Fatal("Received ", method, " before a provisional response")
+	case <-time.After(100 * time.Millisecond):
+	}
+	silent.mutex.Lock()
+	invite := silent.invite
+	silent.mutex.Unlock()
+	silent.respond(invite, 180)
+	silent.expectMethods(t, "CANCEL")
+}
+
+func TestForkSequential(t *testing.T) {
+	store := NewMemoryLocationStore()
+	conn := startForkingProxy(t, SEQUENTIAL, store)
+	var second *branchPeer
+	first := startBranchPeer(t, func(p *branchPeer, invite *Message) {
+		select {
+		case <-second.methods:
+			t.Error("Lower q tried before the higher one answered")
+		default:
+		}
+		answering(486)(p, invite)
+	})
+	second = startBranchPeer(t, answering(200))
+	store.Store("sip:bob@example.com", []Binding{second.binding(0.5), first.binding(1)})
+
+	if m := inviteThrough(t, conn); responseCode(m) != 200 {
+		t.Fatal(m.String())
+	}
+	first.expectMethods(t, "INVITE", "ACK")
+	second.expectMethods(t, "INVITE")
+}
+
+func TestForkMergesChallenges(t *testing.T) {
+	store := NewMemoryLocationStore()
+	conn := startForkingProxy(t, PARALLEL, store)
+	challenging := func(realm string) func(p *branchPeer, invite *Message) {
+		return func(p *branchPeer, invite *Message) {
+			c := CreateResponseTo(invite, 401, ReasonPhrase(401))
+			c.AddHeader("WWW-Authenticate", `Digest realm="`+realm+`", nonce="1"`)
+			p.send(&c)
+		}
+	}
+	store.Store("sip:bob@example.com", []Binding{
+		startBranchPeer(t, challenging("a.example.com")).binding(1),
+		startBranchPeer(t, challenging("b.example.com")).binding(1),
+		startBranchPeer(t, answering(404)).binding(1),
+	})
+
+	m := inviteThrough(t, conn)
+	if responseCode(m) != 401 || len(m.Headers.FindHeadersByName("WWW-Authenticate")) != 2 {
+		t.Fatal(m.String())
+	}
+}
+
+func TestBestResponse(t *testing.T) {
+	req := proxyRequest("INVITE", "sip:bob@example.com")
+	responses := func(codes ...int) []*Message {
+		var messages []*Message
+		for _, code := range codes {
+			c := CreateResponseTo(req, code, ReasonPhrase(code))
+			messages = append(messages, &c)
+		}
+		return messages
+	}
+	tests := []struct {
+		codes    []int
+		expected int
+	}{
+		{[]int{486, 603, 302}, 603},
+		{[]int{486, 302, 500}, 302},
+		{[]int{500, 486}, 486},
+		{[]int{404, 407, 480}, 407},
+		{[]int{404, 415}, 415},
+		{[]int{503}, 500},
+		{[]int{503, 408}, 408},
+	}
+	for _, test := range tests {
+		if best := bestResponse(responses(test.codes...)); responseCode(best) != test.expected {
+			t.Errorf("%v: got %d, expected %d", test.codes, responseCode(best), test.expected)
+		}
+	}
+	if bestResponse(nil) != nil {
+		t.Error("Response without branches")
+	}
+}
@@ -0,0 +1,66 @@
+//go:build gofuzz
+// +build gofuzz
+
+package sip
+
+// Entry points for go-fuzz (github.com/dvyukov/go-fuzz). The messages in
+// testdata/rfc4475 make a good initial corpus for Fuzz:
+//
+//	go-fuzz-build -func Fuzz && go-fuzz -workdir fuzz
+
+// Fuzz parses data as a message. Everything that parses must marshal and
+// parse again.
+func Fuzz(data []byte) int {
+	message, err := ParseMessage(data)
+	if err != nil {
+		if _, ok := err.(*ParseError); !ok {
+			panic("ParseMessage returned an error which is not a *ParseError")
+		}
+		return 0
+	}
+	encoded, err := message.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	if _, err := ParseMessage(encoded); err != nil {
+		panic("Cannot parse marshalled message: " + err.Error())
+	}
+	return 1
+}
+
+func FuzzUri(data []byte) int {
+	uri, err := ParseUri(string(data))
+	if err != nil {
+		return 0
+	}
+	if _, err := ParseUri(uri.String()); err != nil {
+		panic("Cannot parse formatted URI: " + err.Error())
+	}
+	return 1
+}
+
+func FuzzAddress(data []byte) int {
+	addresses, err := ParseAddressList(string(data))
+	if err != nil {
+		return 0
+	}
+	for _, address := range addresses {
+		if _, err := ParseAddress(address.String()); err != nil {
+			panic("Cannot parse formatted address: " + err.Error())
+		}
+	}
+	return 1
+}
+
+func FuzzVia(data []byte) int {
+	vias, err := ParseVia(string(data))
+	if err != nil {
+		return 0
+	}
+	for _, via := range vias {
+		if _, err := ParseVia(via.String()); err != nil {
+			panic("Cannot parse formatted Via: " + err.Error())
+		}
+	}
+	return 1
+}
@@ -0,0 +1,296 @@
+package sip
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var compactHeaderNames = map[string]string{
+	"a": "Accept-Contact",
+	"b": "Referred-By",
+	"c": "Content-Type",
+	"d": "Request-Disposition",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"j": "Reject-Contact",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"t": "To",
+	"u": "Allow-Events",
+	"v": "Via",
+	"x": "Session-Expires",
+}
+
+var knownHeaderNames = map[string]string{}
+
+func init() {
+	for _, name := range []string{
+		"Accept", "Accept-Encoding", "Accept-Language", "Alert-Info", "Allow",
+		"Allow-Events", "Authentication-Info", "Authorization", "Call-ID",
+		"Call-Info", "Contact", "Content-Disposition", "Content-Encoding",
+		"Content-Language", "Content-Length", "Content-Type", "CSeq", "Date",
+		"Error-Info", "Event", "Expires", "Flow-Timer", "From", "In-Reply-To",
+		"Max-Forwards", "MIME-Version", "Min-Expires", "Min-SE", "Organization",
+		"Path", "Priority", "Proxy-Authenticate", "Proxy-Authorization",
+		"Proxy-Require", "RAck", "Record-Route", "Refer-To", "Referred-By",
+		"Reply-To", "Require", "Retry-After", "Route", "RSeq", "Server",
+		"Session-Expires", "Subject", "Supported", "Timestamp", "To",
+		"Unsupported", "User-Agent", "Via", "Warning", "WWW-Authenticate",
+	} {
+		knownHeaderNames[strings.ToLower(name)] = name
+	}
+}
+
+// canonicalHeaderName expands compact forms and normalizes the case of
+// well-known header names. Unknown names are returned unchanged.
+func canonicalHeaderName(name string) string {
+	lower := strings.ToLower(name)
+	if long, ok := compactHeaderNames[lower]; ok {
+		return long
+	}
+	if known, ok := knownHeaderNames[lower]; ok {
+		return known
+	}
+	return name
+}
+
+// splitOutside splits s at every sep that is neither inside a quoted
+// string nor inside angle brackets.
+func splitOutside(s string, sep string) []string {
+	var parts []string
+	quoted := false
+	escaped := false
+	angle := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '<':
+			angle++
+		case !quoted && c == '>' && angle > 0:
+			angle--
+		case !quoted && angle == 0 && strings.HasPrefix(s[i:], sep):
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	unquoted := ""
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		unquoted += string(s[i])
+	}
+	return unquoted
+}
+
+// closingQuote returns the index of the quote terminating the quoted
+// string starting at s[0], or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// ---------------
+
+// Address is a name-addr or addr-spec as found in From, To, Contact,
+// Route and Record-Route headers.
+type Address struct {
+	DisplayName string
+	Uri         SipUri
+	Params      Params
+	Wildcard    bool
+}
+
+func ParseAddress(value string) (Address, error) {
+	a := Address{}
+	rest := strings.TrimSpace(value)
+	if rest == "*" {
+		a.Wildcard = true
+		return a, nil
+	}
+
+	if strings.HasPrefix(rest, `"`) {
+		end := closingQuote(rest)
+		if end < 0 {
+			return a, errors.New("Unterminated quoted string: " + value)
+		}
+		a.DisplayName = unquote(rest[:end+1])
+		rest = strings.TrimSpace(rest[end+1:])
+		if !strings.HasPrefix(rest, "<") {
+			return a, errors.New("Display name without <URI>: " + value)
+		}
+	}
+
+	if lt := strings.Index(rest, "<"); lt >= 0 {
+		display := strings.TrimSpace(rest[:lt])
+		for _, word := range strings.Fields(display) {
+			if !isToken(word) {
+				return a, errors.New("Invalid display name: " + value)
+			}
+		}
+		if display != "" {
+			a.DisplayName = strings.Join(strings.Fields(display), " ")
+		}
+		gt := strings.Index(rest[lt:], ">")
+		if gt < 0 {
+			return a, errors.New("Missing '>' in address: " + value)
+		}
+		uri, err := ParseUri(rest[lt+1 : lt+gt])
+		if err != nil {
+			return a, err
+		}
+		a.Uri = uri
+		rest = strings.TrimSpace(rest[lt+gt+1:])
+	} else {
+		uriPart := rest
+		rest = ""
+		if semicolon := strings.Index(uriPart, ";"); semicolon >= 0 {
+			rest = uriPart[semicolon:]
+			uriPart = uriPart[:semicolon]
+		}
+		if strings.ContainsAny(uriPart, "?,") {
+			return a, errors.New("Invalid addr-spec: " + value)
+		}
+		uri, err := ParseUri(strings.TrimSpace(uriPart))
+		if err != nil {
+			return a, err
+		}
+		a.Uri = uri
+	}
+
+	if rest != "" {
+		if !strings.HasPrefix(rest, ";") {
+			return a, errors.New("Unexpected characters after address: " + value)
+		}
+		params, err := parseParams(rest[1:], ";")
+		if err != nil {
+			return a, err
+		}
+		a.Params = params
+	}
+	return a, nil
+}
+
+func ParseAddressList(value string) ([]Address, error) {
+	var addresses []Address
+	for _, item := range splitOutside(value, ",") {
+		address, err := ParseAddress(item)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+func (a Address) Tag() string {
+	tag, _ := a.Params.Get("tag")
+	return tag
+}
+
+func (a Address) String() string {
+	if a.Wildcard {
+		return "*"
+	}
+	s := ""
+	if a.DisplayName != "" {
+		s = quote(a.DisplayName) + " "
+	}
+	return s + "<" + a.Uri.String() + ">" + a.Params.String()
+}
+
+// ---------------
+
+type Via struct {
+	ProtocolName    string
+	ProtocolVersion string
+	Transport       string
+	Host            string
+	Port            int
+	Params          Params
+}
+
+var viaSlash = regexp.MustCompile(`\s*/\s*`)
+
+func ParseVia(value string) ([]Via, error) {
+	var vias []Via
+	for _, item := range splitOutside(value, ",") {
+		item = strings.TrimSpace(item)
+		v := Via{}
+
+		sentPart := item
+		if semicolon := strings.Index(item, ";"); semicolon >= 0 {
+			sentPart = item[:semicolon]
+			params, err := parseParams(item[semicolon+1:], ";")
+			if err != nil {
+				return nil, err
+			}
+			v.Params = params
+		}
+
+		fields := strings.Fields(viaSlash.ReplaceAllString(sentPart, "/"))
+		if len(fields) != 2 {
+			return nil, errors.New("Malformed Via: " + item)
+		}
+		protocol := strings.Split(fields[0], "/")
+		if len(protocol) != 3 || !isToken(protocol[0]) || !isToken(protocol[1]) || !isToken(protocol[2]) {
+			return nil, errors.New("Malformed Via protocol: " + item)
+		}
+		v.ProtocolName = protocol[0]
+		v.ProtocolVersion = protocol[1]
+		v.Transport = strings.ToUpper(protocol[2])
+
+		host, port, err := splitHostPort(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		v.Host = host
+		v.Port = port
+		vias = append(vias, v)
+	}
+	return vias, nil
+}
+
+func (v Via) Branch() string {
+	branch, _ := v.Params.Get("branch")
+	return branch
+}
+
+func (v Via) String() string {
+	return v.ProtocolName + "/" + v.ProtocolVersion + "/" + v.Transport + " " + joinHostPort(v.Host, v.Port) + v.Params.String()
+}
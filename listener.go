@@ -4,7 +4,7 @@ import (
 	"errors"
 	"log"
 	"net"
-	"strconv"
+	"sync"
 )
 
 type Connectinfo struct {
@@ -26,7 +26,7 @@ func Dial(transport string, host string, port int) (Outbound, error) {
 		host,
 		port,
 	}
-	socket, err := net.Dial(transport, host+":"+strconv.Itoa(port))
+	socket, err := net.Dial(transport, netAddress(host, port))
 	if err != nil {
 		return Outbound{}, errors.New("Could not connect:" + err.Error())
 	}
@@ -36,38 +36,74 @@ func Dial(transport string, host string, port int) (Outbound, error) {
 
 type Listener struct {
 	Connectinfo
-	conns           []net.Conn
+	conns           map[net.Conn]bool
 	listener        net.Listener
 	running         bool
 	stoppingChannel chan bool
+	mutex           sync.Mutex
+	stopOnce        sync.Once
 }
 
+// Stop stops accepting connections and closes the accepted ones. It may
+// be called more than once.
 func (l *Listener) Stop() {
-	l.running = false
-	l.listener.Close()
-	_ = <-l.stoppingChannel
+	l.stopOnce.Do(func() {
+		l.mutex.Lock()
+		l.running = false
+		conns := l.conns
+		l.conns = nil
+		l.mutex.Unlock()
+		if l.listener == nil {
+			return
+		}
+		l.listener.Close()
+		<-l.stoppingChannel
+		for conn := range conns {
+			conn.Close()
+		}
+	})
+}
+
+// forget closes conn and stops tracking it once d stopped reading it.
+func (l *Listener) forget(conn net.Conn, d *Dialog) {
+	<-d.Parser.Done()
+	l.mutex.Lock()
+	delete(l.conns, conn)
+	l.mutex.Unlock()
+	conn.Close()
 }
 
 func CreateListener(transport string, host string, port int, sipClient *SipClient, dialogListener func(d *Dialog)) *Listener {
 	var err error
 	var l Listener = Listener{}
 	l.stoppingChannel = make(chan bool, 1)
+	l.conns = make(map[net.Conn]bool)
 	l.Host = host
 	l.Port = port
 	l.Transport = transport
-	l.listener, err = net.Listen(transport, host+":"+strconv.Itoa(port))
+	l.listener, err = net.Listen(transport, netAddress(host, port))
 	if err != nil {
 		log.Println("Error listening for ", transport, host, port, " due to ", err)
+		return &l
 	}
 	l.running = true
 
 	go func() {
-		for l.running {
+		for {
 			conn, errListen := l.listener.Accept()
 			if errListen != nil {
 				break
 			}
+			l.mutex.Lock()
+			if !l.running {
+				l.mutex.Unlock()
+				conn.Close()
+				break
+			}
+			l.conns[conn] = true
+			l.mutex.Unlock()
 			d := CreateDialog(conn, sipClient)
+			go l.forget(conn, d)
 			dialogListener(d)
 		}
 		l.stoppingChannel <- true
@@ -0,0 +1,44 @@
+package sip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenerForgetsClosedConnections(t *testing.T) {
+	l := CreateListener("tcp", "127.0.0.1", 0, nil, func(d *Dialog) {})
+	defer l.Stop()
+	address := l.listener.Addr().String()
+
+	count := func() int {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return len(l.conns)
+	}
+	waitFor := func(want int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for count() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Got %d connections, expected %d", count(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	waitFor(3)
+	for _, conn := range conns[:2] {
+		conn.Close()
+	}
+	waitFor(1)
+	conns[2].Close()
+	waitFor(0)
+}
@@ -0,0 +1,89 @@
+package sip
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Binding maps an address-of-record to a contact, as created by a
+// REGISTER (RFC 3261, section 10). Contact keeps its parameters except
+// expires.
+type Binding struct {
+	Contact Address
+	Expires time.Time
+	Q       float64
+	CallID  string
+	CSeq    uint32
+}
+
+// ExpiresIn returns the remaining lifetime of the binding in seconds.
+func (b Binding) ExpiresIn() int {
+	seconds := int(time.Until(b.Expires).Round(time.Second) / time.Second)
+	if seconds < 0 {
+		return 0
+	}
+	return seconds
+}
+
+// LocationStore holds the bindings of a registrar. Lookup only returns
+// bindings which have not expired, ordered by descending q. Store
+// replaces all bindings of an address-of-record.
+type LocationStore interface {
+	Lookup(aor string) ([]Binding, error)
+	Store(aor string, bindings []Binding) error
+}
+
+// MemoryLocationStore is a LocationStore which keeps the bindings in
+// memory.
+type MemoryLocationStore struct {
+	mutex    sync.Mutex
+	bindings map[string][]Binding
+}
+
+func NewMemoryLocationStore() *MemoryLocationStore {
+	return &MemoryLocationStore{
+		bindings: make(map[string][]Binding),
+	}
+}
+
+func (m *MemoryLocationStore) Lookup(aor string) ([]Binding, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	var bindings []Binding
+	for _, binding := range m.bindings[aor] {
+		if binding.Expires.After(now) {
+			bindings = append(bindings, binding)
+		}
+	}
+	sort.SliceStable(bindings, func(i, j int) bool {
+		return bindings[i].Q > bindings[j].Q
+	})
+	return bindings, nil
+}
+
+func (m *MemoryLocationStore) Store(aor string, bindings []Binding) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(bindings) == 0 {
+		delete(m.bindings, aor)
+		return nil
+	}
+	m.bindings[aor] = append([]Binding{}, bindings...)
+	return nil
+}
+
+// addressOfRecord returns the key under which the bindings of uri are
+// stored: scheme, user and host, without port or parameters.
+func addressOfRecord(uri SipUri) string {
+	scheme := strings.ToLower(uri.Scheme)
+	if scheme == "" {
+		scheme = "sip"
+	}
+	if uri.User == "" {
+		return scheme + ":" + joinHostPort(strings.ToLower(uri.Host), 0)
+	}
+	return scheme + ":" + uri.User + "@" + joinHostPort(strings.ToLower(uri.Host), 0)
+}
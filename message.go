@@ -1,6 +1,7 @@
 package sip
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"log"
@@ -30,9 +31,9 @@ func (h *Headers) AddHeader(name string, value string) {
 
 func (h *Headers) ReplaceAddHeader(name string, value string) {
 	found := false
-	for _, crt := range h.Lines {
-		if crt.Name == name {
-			crt.Value = value
+	for i, crt := range h.Lines {
+		if canonicalHeaderName(crt.Name) == canonicalHeaderName(name) {
+			h.Lines[i].Value = value
 			found = true
 		}
 	}
@@ -41,15 +42,48 @@ func (h *Headers) ReplaceAddHeader(name string, value string) {
 	}
 }
 
+// PrependHeader adds a header above all headers of the same name, e.g.
+// a Via or Record-Route inserted by a proxy.
+func (h *Headers) PrependHeader(name string, value string) {
+	i := 0
+	for i < len(h.Lines) && canonicalHeaderName(h.Lines[i].Name) != canonicalHeaderName(name) {
+		i++
+	}
+	if i == len(h.Lines) {
+		i = 0
+	}
+	h.Lines = append(h.Lines[:i], append([]HeaderLine{{name, value}}, h.Lines[i:]...)...)
+}
+
+func (h *Headers) RemoveHeader(name string) {
+	var kept []HeaderLine
+	for _, crt := range h.Lines {
+		if canonicalHeaderName(crt.Name) != canonicalHeaderName(name) {
+			kept = append(kept, crt)
+		}
+	}
+	h.Lines = kept
+}
+
 func (h *Headers) FindHeaderByName(name string) (header HeaderLine, err error) {
 	for _, crt := range h.Lines {
-		if crt.Name == name {
+		if canonicalHeaderName(crt.Name) == canonicalHeaderName(name) {
 			return crt, nil
 		}
 	}
 	return HeaderLine{}, errors.New("Not found")
 }
 
+func (h *Headers) FindHeadersByName(name string) []HeaderLine {
+	var found []HeaderLine
+	for _, crt := range h.Lines {
+		if canonicalHeaderName(crt.Name) == canonicalHeaderName(name) {
+			found = append(found, crt)
+		}
+	}
+	return found
+}
+
 // ---------------
 
 type Headline interface {
@@ -88,9 +122,9 @@ func (m *Message) GetFrom() string {
 func (m *Message) SetFrom(proto string, user string, host string, tag string) *Message {
 	var value string
 	if tag == "" {
-		value = fmt.Sprintf("<%s:%s@%s>", proto, user, host)
+		value = fmt.Sprintf("<%s:%s@%s>", proto, user, joinHostPort(host, 0))
 	} else {
-		value = fmt.Sprintf("<%s:%s@%s>;tag=%s", proto, user, host, tag)
+		value = fmt.Sprintf("<%s:%s@%s>;tag=%s", proto, user, joinHostPort(host, 0), tag)
 	}
 	m.Headers.ReplaceAddHeader("From", value)
 	return m
@@ -102,7 +136,7 @@ func (m *Message) SetFromValue(value string) *Message {
 
 func (m *Message) SetContact(proto string, user string, host string, port int) *Message {
 	var value string
-	value = fmt.Sprintf("<%s:%s@%s:%d>;transport=tcp", proto, user, host, port)
+	value = fmt.Sprintf("<%s:%s@%s>;transport=tcp", proto, user, joinHostPort(host, port))
 	m.Headers.ReplaceAddHeader("Contact", value)
 	return m
 }
@@ -125,9 +159,9 @@ func (m *Message) GetTo() string {
 func (m *Message) SetTo(proto string, user string, host string, tag string) *Message {
 	var value string
 	if tag == "" {
-		value = fmt.Sprintf("<%s:%s@%s>", proto, user, host)
+		value = fmt.Sprintf("<%s:%s@%s>", proto, user, joinHostPort(host, 0))
 	} else {
-		value = fmt.Sprintf("<%s:%s@%s>;tag=%s", proto, user, host, tag)
+		value = fmt.Sprintf("<%s:%s@%s>;tag=%s", proto, user, joinHostPort(host, 0), tag)
 	}
 	m.Headers.ReplaceAddHeader("To", value)
 	return m
@@ -137,6 +171,47 @@ func (m *Message) SetToValue(value string) *Message {
 	return m
 }
 
+func (m *Message) FromAddress() (Address, error) {
+	header, err := m.Headers.FindHeaderByName("From")
+	if err != nil {
+		return Address{}, err
+	}
+	return ParseAddress(header.Value)
+}
+
+func (m *Message) ToAddress() (Address, error) {
+	header, err := m.Headers.FindHeaderByName("To")
+	if err != nil {
+		return Address{}, err
+	}
+	return ParseAddress(header.Value)
+}
+
+func (m *Message) Contacts() ([]Address, error) {
+	var contacts []Address
+	for _, header := range m.Headers.FindHeadersByName("Contact") {
+		addresses, err := ParseAddressList(header.Value)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, addresses...)
+	}
+	return contacts, nil
+}
+
+// Vias returns all Via entries of the message, topmost first.
+func (m *Message) Vias() ([]Via, error) {
+	var vias []Via
+	for _, header := range m.Headers.FindHeadersByName("Via") {
+		parsed, err := ParseVia(header.Value)
+		if err != nil {
+			return nil, err
+		}
+		vias = append(vias, parsed...)
+	}
+	return vias, nil
+}
+
 func (m *Message) GetVia() string {
 	header, err := m.Headers.FindHeaderByName("Via")
 	if err != nil {
@@ -146,10 +221,62 @@ func (m *Message) GetVia() string {
 }
 
 func (m *Message) SetVia(transport string, host string, port int, branch string) *Message {
-	value := fmt.Sprintf("SIP/2.0/%s %s:%d;rport;branch=z9hG4bK%s", transport, host, port, branch)
+	value := fmt.Sprintf("SIP/2.0/%s %s;rport;branch=z9hG4bK%s", strings.ToUpper(transport), joinHostPort(host, port), branch)
 	m.Headers.ReplaceAddHeader("Via", value)
 	return m
 }
+
+// SetTopViaBranch replaces the branch parameter of the topmost Via.
+func (m *Message) SetTopViaBranch(branch string) *Message {
+	return m.SetTopViaParam("branch", branch)
+}
+
+// SetTopViaParam sets a parameter of the topmost Via.
+func (m *Message) SetTopViaParam(name string, value string) *Message {
+	for i, crt := range m.Headers.Lines {
+		if canonicalHeaderName(crt.Name) != "Via" {
+			continue
+		}
+		vias, err := ParseVia(crt.Value)
+		if err != nil {
+			log.Println("Cannot parse Via", err)
+			return m
+		}
+		vias[0].Params.Set(name, value)
+		var values []string
+		for _, via := range vias {
+			values = append(values, via.String())
+		}
+		m.Headers.Lines[i].Value = strings.Join(values, ", ")
+		return m
+	}
+	return m
+}
+
+// PopVia removes the topmost Via entry and returns it.
+func (m *Message) PopVia() (Via, error) {
+	for i, crt := range m.Headers.Lines {
+		if canonicalHeaderName(crt.Name) != "Via" {
+			continue
+		}
+		vias, err := ParseVia(crt.Value)
+		if err != nil {
+			return Via{}, err
+		}
+		if len(vias) == 1 {
+			m.Headers.Lines = append(m.Headers.Lines[:i], m.Headers.Lines[i+1:]...)
+			return vias[0], nil
+		}
+		var values []string
+		for _, via := range vias[1:] {
+			values = append(values, via.String())
+		}
+		m.Headers.Lines[i].Value = strings.Join(values, ", ")
+		return vias[0], nil
+	}
+	return Via{}, errors.New("Not found")
+}
+
 func (m *Message) SetViaValue(value string) *Message {
 	m.Headers.ReplaceAddHeader("Via", value)
 	return m
@@ -177,9 +304,13 @@ func (m *Message) GetCSeq() (number uint32, verb string) {
 	if err != nil {
 		log.Println("Error finding header CSeq", err)
 	}
-	headerLine := strings.Split(header.Value, " ")
+	headerLine := strings.Fields(header.Value)
+	if len(headerLine) != 2 {
+		log.Println("Cannot parse CSeq " + header.Value)
+		return 0, ""
+	}
 	numberString := headerLine[0]
-	number64, parseErr := strconv.ParseUint(numberString, 10, 0)
+	number64, parseErr := strconv.ParseUint(numberString, 10, 32)
 	number = uint32(number64)
 	verb = headerLine[1]
 	if parseErr != nil {
@@ -189,33 +320,64 @@ func (m *Message) GetCSeq() (number uint32, verb string) {
 	return number, verb
 }
 func (m *Message) SetCSeq(number uint32, verb string) *Message {
-	m.Headers.AddHeader("CSeq", strconv.FormatUint(uint64(number), 10)+" "+verb)
+	m.Headers.ReplaceAddHeader("CSeq", strconv.FormatUint(uint64(number), 10)+" "+verb)
+	return m
+}
+
+func (m *Message) GetExpires() (int, error) {
+	return m.getSecondsHeader("Expires")
+}
+
+func (m *Message) SetExpires(value int) *Message {
+	m.Headers.ReplaceAddHeader("Expires", strconv.Itoa(value))
 	return m
 }
 
-func (m *Message) GetExpires() int {
-	header, err := m.Headers.FindHeaderByName("Expires")
+func (m *Message) GetMinExpires() (int, error) {
+	return m.getSecondsHeader("Min-Expires")
+}
+
+// GetRetryAfter returns the delay of a Retry-After header, ignoring
+// comments and parameters.
+func (m *Message) GetRetryAfter() (int, error) {
+	header, err := m.Headers.FindHeaderByName("Retry-After")
 	if err != nil {
-		log.Println("Field 'Expires' could not be found. Assume 120")
-		return 120
+		return 0, err
 	}
-	expirationValue, err := strconv.Atoi(header.Value)
-	if err != nil {
-		log.Println("Field 'Expires' could not be parsed. Assume 120")
-		return 120
+	value := strings.TrimSpace(header.Value)
+	end := strings.IndexAny(value, " \t(;")
+	if end >= 0 {
+		value = value[:end]
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, errors.New("Field 'Retry-After' could not be parsed: " + header.Value)
 	}
-	return expirationValue
+	return seconds, nil
 }
 
-func (m *Message) SetExpires(value int) *Message {
-	m.Headers.AddHeader("Expires", strconv.Itoa(300))
-	return m
+func (m *Message) getSecondsHeader(name string) (int, error) {
+	header, err := m.Headers.FindHeaderByName(name)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.Atoi(header.Value)
+	if err != nil || value < 0 {
+		return 0, errors.New("Field '" + name + "' could not be parsed: " + header.Value)
+	}
+	return value, nil
 }
 
 func (m *Message) SetDigestAuthorizationHeader(authInfo AuthInformation) *Message {
-	value := fmt.Sprintf(`Digest username="%s" realm="%s" nonce="%s" response="%s"`, authInfo.Username, authInfo.Wwwauth.Realm, authInfo.Wwwauth.Nonce, authInfo.FinalHash())
-	m.Headers.AddHeader("Authorization", value)
-	log.Println(value)
+	if request, ok := m.Headline.(RequestHeadline); ok {
+		authInfo.Method = request.Method
+		authInfo.URL = request.Uri.String()
+	}
+	if authInfo.Body == nil {
+		authInfo.Body = m.Body
+	}
+	value := authInfo.AuthorizationValue()
+	m.Headers.AddHeader(authInfo.Wwwauth.AuthorizationHeaderName(), value)
 	return m
 }
 
@@ -224,23 +386,81 @@ func (m *Message) SetAllow(actions []string) *Message {
 	return m
 }
 
+// OptionTags returns the option tags of all headers called name, e.g.
+// Supported or Require.
+func (m *Message) OptionTags(name string) []string {
+	var tags []string
+	for _, header := range m.Headers.FindHeadersByName(name) {
+		for _, tag := range strings.Split(header.Value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// HasOptionTag tells whether tag is listed in a header called name.
+func (m *Message) HasOptionTag(name string, tag string) bool {
+	for _, crt := range m.OptionTags(name) {
+		if strings.EqualFold(crt, tag) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Message) AddHeader(name string, value string) *Message {
 	m.Headers.AddHeader(name, value)
 	return m
 }
 
+func (m *Message) GetMaxForwards() (int, error) {
+	return m.getSecondsHeader("Max-Forwards")
+}
+
+func (m *Message) SetMaxForwards(value int) *Message {
+	m.Headers.ReplaceAddHeader("Max-Forwards", strconv.Itoa(value))
+	return m
+}
+
 func (m *Message) GetType() MessageType {
 	return m.MessageType
 }
 
-func (m *Message) String() string {
-	s := ""
-	s += m.Headline.ToString() + "\n"
+// Clone returns a copy of the message which can be modified without
+// affecting m.
+func (m *Message) Clone() Message {
+	c := *m
+	c.Headers.Lines = append([]HeaderLine{}, m.Headers.Lines...)
+	c.Body = append([]byte{}, m.Body...)
+	return c
+}
+
+// MarshalBinary encodes the message with CRLF line endings. Any
+// Content-Length header is replaced by the actual length of the body.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if m.Headline == nil {
+		return nil, errors.New("Message has no headline")
+	}
+	var b bytes.Buffer
+	b.WriteString(m.Headline.ToString() + "\r\n")
 	for _, crtHeader := range m.Headers.Lines {
-		crtLine := crtHeader.Name + ": " + crtHeader.Value + "\n"
-		s += crtLine
+		if canonicalHeaderName(crtHeader.Name) == "Content-Length" {
+			continue
+		}
+		b.WriteString(crtHeader.Name + ": " + crtHeader.Value + "\r\n")
+	}
+	b.WriteString("Content-Length: " + strconv.Itoa(len(m.Body)) + "\r\n")
+	b.WriteString("\r\n")
+	b.Write(m.Body)
+	return b.Bytes(), nil
+}
+
+func (m *Message) String() string {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return ""
 	}
-	s += "\n"
-	s += string(m.Body)
-	return s
+	return string(data)
 }
@@ -8,18 +8,6 @@ import (
 
 const sipversion = "2.0"
 
-type SipUri struct {
-	uri string
-}
-
-func ParseSipUri(uri string) SipUri {
-	return SipUri{uri}
-}
-
-func (s *SipUri) String() string {
-	return s.uri
-}
-
 // Readln returns a single line (without the ending \n)
 // from the input buffered reader.
 // An error is returned iff there is an error with the
@@ -0,0 +1,236 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unacceptedBodies can be decoded, but the user agent neither picks one
+// of the alternatives nor resolves the references between related parts.
+var unacceptedBodies = map[string]bool{
+	"multipart/alternative": true,
+	"multipart/related":     true,
+}
+
+// acceptedBodies returns the media types of the bodies the user agent
+// handles, including those of RegisterBodyDecoder.
+func acceptedBodies() []string {
+	var types []string
+	bodyDecodersMutex.RLock()
+	for mediaType := range bodyDecoders {
+		if !unacceptedBodies[mediaType] {
+			types = append(types, mediaType)
+		}
+	}
+	bodyDecodersMutex.RUnlock()
+	sort.Strings(types)
+	return types
+}
+
+// supportedOptions returns the option tags of the extensions in use: SIP
+// Outbound if an account registers with it, or if the Registrar keeps
+// its flows.
+func (s *SipClient) supportedOptions() []string {
+	if s.Registrar != nil {
+		return []string{"outbound"}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, r := range s.registrations {
+		if r.info.usesOutbound() {
+			return []string{"outbound"}
+		}
+	}
+	return nil
+}
+
+// allowedMethods returns the methods this client answers as a user agent
+// or with its Registrar.
+func (s *SipClient) allowedMethods() []string {
+	methods := []string{"INVITE", "ACK", "CANCEL", "OPTIONS"}
+	if s.Registrar != nil {
+		methods = append(methods, "REGISTER")
+	}
+	return methods
+}
+
+// answerOptions answers an OPTIONS request with our capabilities (RFC
+// 3261, section 11.2).
+func (s *SipClient) answerOptions(d *Dialog, req *Message) {
+	c := CreateResponseTo(req, 200, "OK")
+	c.SetAllow(s.allowedMethods())
+	c.AddHeader("Accept", strings.Join(acceptedBodies(), ", "))
+	if supported := s.supportedOptions(); len(supported) > 0 {
+		c.AddHeader("Supported", strings.Join(supported, ", "))
+	}
+	c.AddHeader("Server", "sipbell/0.1")
+	c.SetContentLength(0)
+	d.sendMessage(&c)
+}
+
+// Ping sends an OPTIONS request on behalf of the account of info to
+// target, or to its registrar if target is empty. Any response means the
+// peer is reachable, even if it rejects the request, except 503, which
+// a pinger takes as the peer being down.
+func (s *SipClient) Ping(ctx context.Context, info *RegisterInfo, target string) (*Message, error) {
+	if target == "" {
+		target = registrarUri(info.Registrar)
+	}
+	req := info.NewRequest("OPTIONS", target)
+	req.AddHeader("Accept", strings.Join(acceptedBodies(), ", "))
+	req.SetContentLength(0)
+	return s.SendAs(ctx, info, &req)
+}
+
+type PeerState int
+
+const (
+	PEER_UNKNOWN PeerState = iota
+	PEER_UP
+	PEER_DOWN
+)
+
+func (p PeerState) String() string {
+	switch p {
+	case PEER_UNKNOWN:
+		return "PEER_UNKNOWN"
+	case PEER_UP:
+		return "PEER_UP"
+	case PEER_DOWN:
+		return "PEER_DOWN"
+	}
+	return "UNKNOWN"
+}
+
+// PeerEvent reports a change of the state of a peer. Code is the status
+// code of the response if there was one, Err why the peer is down.
+type PeerEvent struct {
+	State PeerState
+	Code  int
+	Err   error
+	RTT   time.Duration
+}
+
+// DefaultPingInterval is the interval of pingers started with an
+// interval of 0.
+var DefaultPingInterval = 30 * time.Second
+
+// Pinger sends OPTIONS to a peer periodically and reports whether it
+// answers. Changes delivers every change of the state; events are dropped
+// if the channel is not drained. The channel is closed once the pinger is
+// stopped.
+type Pinger struct {
+	client   *SipClient
+	info     *RegisterInfo
+	target   string
+	interval time.Duration
+
+	mutex   sync.Mutex
+	state   PeerState
+	changes chan PeerEvent
+	cancel  context.CancelFunc
+	done    chan bool
+}
+
+// StartPinger pings target, or the registrar if it is empty, on behalf of
+// the account of info every interval until the pinger is stopped. A
+// ping without a response within interval marks the peer down.
+func (s *SipClient) StartPinger(info *RegisterInfo, target string, interval time.Duration) *Pinger {
+	if interval <= 0 {
+		interval = DefaultPingInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pinger{
+		client:   s,
+		info:     info,
+		target:   target,
+		interval: interval,
+		state:    PEER_UNKNOWN,
+		changes:  make(chan PeerEvent, 16),
+		cancel:   cancel,
+		done:     make(chan bool),
+	}
+	s.mutex.Lock()
+	if s.pingers == nil {
+		s.pingers = make(map[*Pinger]bool)
+	}
+	s.pingers[p] = true
+	s.mutex.Unlock()
+	go p.run(ctx)
+	return p
+}
+
+func (p *Pinger) State() PeerState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state
+}
+
+func (p *Pinger) Changes() <-chan PeerEvent {
+	return p.changes
+}
+
+func (p *Pinger) run(ctx context.Context) {
+	defer close(p.done)
+	defer close(p.changes)
+	for {
+		p.ping(ctx)
+		select {
+		case <-time.After(p.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Pinger) ping(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+	start := time.Now()
+	response, err := p.client.Ping(ctx, p.info, p.target)
+	if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+	event := PeerEvent{State: PEER_DOWN, Err: err, RTT: time.Since(start)}
+	if err == nil {
+		event.State = PEER_UP
+		event.Code = response.Headline.(ResponseHeadline).Code
+		if event.Code == 503 {
+			// The peer is overloaded or out of service (RFC 3261,
+			// section 21.5.4).
+			event.State = PEER_DOWN
+			event.Err = errors.New("Service unavailable")
+			err = event.Err
+		}
+	}
+
+	p.mutex.Lock()
+	changed := p.state != event.State
+	p.state = event.State
+	p.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if event.State == PEER_DOWN {
+		log.Println("Peer down: ", err)
+	}
+	select {
+	case p.changes <- event:
+	default:
+		log.Println("Peer event dropped: ", event.State)
+	}
+}
+
+// Stop stops pinging and closes Changes.
+func (p *Pinger) Stop() {
+	p.client.mutex.Lock()
+	delete(p.client.pingers, p)
+	p.client.mutex.Unlock()
+	p.cancel()
+	<-p.done
+}
@@ -0,0 +1,93 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// optionsAnswer returns the answer of s to an OPTIONS request.
+func optionsAnswer(t *testing.T, s *SipClient) *Message {
+	local, remote := net.Pipe()
+	defer local.Close()
+	d := CreateDialog(remote, s)
+	defer remote.Close()
+	answers := make(chan *Message, 1)
+	p := NewParser(local)
+	p.SetCallback(func(m *Message) { answers <- m })
+	p.StartParsing()
+
+	info := &RegisterInfo{Registrar: Connectinfo{"tcp", "example.com", 5060}, Client: Connectinfo{"tcp", "127.0.0.1", 5060}, Username: "alice"}
+	req := info.NewRequest("OPTIONS", "sip:example.com")
+	go s.answerOptions(d, &req)
+	select {
+	case m := <-answers:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("No answer to OPTIONS")
+	}
+	return nil
+}
+
+func TestAnswerOptions(t *testing.T) {
+	s := CreateClient()
+	m := optionsAnswer(t, &s)
+	accept, err := m.Headers.FindHeaderByName("Accept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mediaType := range []string{"application/sdp", "message/sipfrag", "multipart/mixed", "text/plain"} {
+		if !strings.Contains(accept.Value, mediaType) {
+			t.Errorf("Accept: %s misses %s", accept.Value, mediaType)
+		}
+	}
+	for _, mediaType := range []string{"multipart/alternative", "multipart/related"} {
+		if strings.Contains(accept.Value, mediaType) {
+			t.Errorf("Accept: %s has %s", accept.Value, mediaType)
+		}
+	}
+	if m.HasOptionTag("Supported", "outbound") {
+		t.Error("Supported: outbound without outbound registration")
+	}
+
+	s.Registrar = NewRegistrar(NewMemoryLocationStore())
+	if m := optionsAnswer(t, &s); !m.HasOptionTag("Supported", "outbound") {
+		t.Error("Supported: outbound missing for Registrar")
+	}
+}
+
+func TestPingerServiceUnavailable(t *testing.T) {
+	peer := startUDPServer(t, false)
+	s := CreateClient()
+	defer s.Shutdown()
+	info := &RegisterInfo{
+		Registrar: Connectinfo{"udp", "127.0.0.1", peer.port},
+		Client:    Connectinfo{"udp", "127.0.0.1", 5060},
+		Username:  "alice",
+		UserInfo:  UnauthorizedUserInfo("alice"),
+	}
+	p := s.StartPinger(info, "", 100*time.Millisecond)
+	defer p.Stop()
+
+	next := func() PeerEvent {
+		select {
+		case event := <-p.Changes():
+			return event
+		case <-time.After(2 * time.Second):
+			t.Fatal("No peer event")
+		}
+		return PeerEvent{}
+	}
+	if event := next(); event.State != PEER_UP || event.Code != 200 {
+		t.Fatal(event)
+	}
+	peer.setCode(503)
+	if event := next(); event.State != PEER_DOWN || event.Code != 503 || event.Err == nil {
+		t.Fatal(event)
+	}
+	peer.setCode(404)
+	if event := next(); event.State != PEER_UP || event.Code != 404 {
+		t.Fatal(event)
+	}
+}
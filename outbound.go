@@ -0,0 +1,322 @@
+package sip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pongTimeout is how long a flow waits for the answer to a keepalive
+// before it is considered failed (RFC 5626, section 4.4.1).
+var pongTimeout = 10 * time.Second
+
+// usesOutbound tells whether the account registers with SIP Outbound.
+func (r *RegisterInfo) usesOutbound() bool {
+	return r.InstanceID != "" && r.RegID > 0
+}
+
+// outboundContactParams returns the Contact parameters of an outbound
+// registration (RFC 5626, section 4.2).
+func (r *RegisterInfo) outboundContactParams() Params {
+	return Params{
+		{"reg-id", strconv.Itoa(r.RegID)},
+		{"+sip.instance", `"<` + r.InstanceID + `>"`},
+	}
+}
+
+// registerConnection returns the connection for the next REGISTER of r:
+// the open flow of an outbound registration, or a new connection.
+func (s *SipClient) registerConnection(ctx context.Context, r *Registration, dest Connectinfo) (*clientConnection, error) {
+	if r.info.usesOutbound() {
+		r.mutex.Lock()
+		flow := r.flow
+		r.mutex.Unlock()
+		if flow != nil && flow.isOpen() {
+			flow.acquire()
+			return flow, nil
+		}
+	}
+	return s.dial(ctx, dest)
+}
+
+// useFlow keeps conn, acquired for a successful REGISTER, as the flow of
+// r and starts its keepalives.
+func (r *Registration) useFlow(conn *clientConnection, response *Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.flow == conn {
+		conn.release()
+		return
+	}
+	if r.flow != nil {
+		r.flow.release()
+	}
+	r.flow = conn
+	confirmed := response.HasOptionTag("Require", "outbound")
+	flowTimer, err := response.getSecondsHeader("Flow-Timer")
+	if err != nil {
+		flowTimer = 0
+	}
+	go r.watchFlow(conn, confirmed, flowTimer)
+}
+
+// dropFlow forgets conn if it is the flow of r, so that closing it is not
+// treated as a failure. It returns true if the flow's use of conn must
+// be released.
+func (r *Registration) dropFlow(conn *clientConnection) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.flow == conn {
+		r.flow = nil
+		return true
+	}
+	return false
+}
+
+// closeFlow gives up the flow of r. The connection stays open while it is
+// used otherwise.
+func (r *Registration) closeFlow() {
+	r.mutex.Lock()
+	flow := r.flow
+	r.flow = nil
+	r.mutex.Unlock()
+	if flow != nil {
+		flow.release()
+	}
+}
+
+func (r *Registration) isFlow(flow *clientConnection) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.flow == flow
+}
+
+// watchFlow sends keepalives on flow until it fails or is closed. A
+// failure of the current flow makes the registration register again.
+func (r *Registration) watchFlow(flow *clientConnection, confirmed bool, flowTimer int) {
+	for {
+		select {
+		case <-flow.closed():
+			r.flowFailure(flow, errors.New("Connection closed"))
+			return
+		case <-time.After(r.keepaliveDelay(flow, flowTimer)):
+		}
+		if !r.isFlow(flow) {
+			return
+		}
+		if err := flow.keepalive(confirmed); err != nil {
+			r.flowFailure(flow, err)
+			flow.close()
+			return
+		}
+	}
+}
+
+func (r *Registration) flowFailure(flow *clientConnection, err error) {
+	r.mutex.Lock()
+	current := r.flow == flow
+	if current {
+		r.flow = nil
+	}
+	r.mutex.Unlock()
+	if !current {
+		return
+	}
+	log.Println("Registration flow failed: ", err)
+	select {
+	case r.flowFailed <- err:
+	default:
+	}
+}
+
+// keepaliveDelay returns the time until the next keepalive: KeepaliveInterval
+// if set, 80 to 100% of the Flow-Timer of the registrar, or the defaults of
+// RFC 5626, section 4.4.1: 95 to 120 seconds on connections and 24 to 29
+// seconds on UDP.
+func (r *Registration) keepaliveDelay(flow *clientConnection, flowTimer int) time.Duration {
+	if r.info.KeepaliveInterval > 0 {
+		return r.info.KeepaliveInterval
+	}
+	if flowTimer > 0 {
+		max := time.Duration(flowTimer) * time.Second
+		return max*8/10 + time.Duration(mathrand.Int63n(int64(max/5)+1))
+	}
+	if _, ok := flow.dialog.Conn.(*stunConn); ok {
+		return 24*time.Second + time.Duration(mathrand.Int63n(int64(5*time.Second)))
+	}
+	return 95*time.Second + time.Duration(mathrand.Int63n(int64(25*time.Second)))
+}
+
+// keepalive sends a STUN binding request on UDP or a double-CRLF ping
+// otherwise, never a double CRLF on UDP (RFC 5626, section 4.4.2). If the
+// registrar confirmed outbound support, an answer is required within
+// pongTimeout; without it the keepalive only refreshes NAT bindings.
+func (c *clientConnection) keepalive(confirmed bool) error {
+	if stun, ok := c.dialog.Conn.(*stunConn); ok {
+		if !confirmed {
+			_, err := stun.Conn.Write(stunBindingRequest(newStunTransactionID()))
+			return err
+		}
+		return stun.keepalive()
+	}
+	select {
+	case <-c.pongs:
+	default:
+	}
+	if _, err := c.dialog.Conn.Write([]byte("\r\n\r\n")); err != nil {
+		return err
+	}
+	if !confirmed {
+		return nil
+	}
+	select {
+	case <-c.pongs:
+		return nil
+	case <-c.closed():
+		return errors.New("Connection closed")
+	case <-time.After(pongTimeout):
+		return errors.New("No keepalive pong received")
+	}
+}
+
+// ---------------
+
+const stunMagicCookie = 0x2112A442
+
+// stunConn separates STUN messages (RFC 5389) from SIP on a UDP flow, so
+// that STUN keepalives can share the socket with SIP (RFC 5626, section
+// 4.4.2).
+type stunConn struct {
+	net.Conn
+
+	mutex   sync.Mutex
+	pending map[string]chan []byte
+	mapped  string
+}
+
+func newStunConn(conn net.Conn) *stunConn {
+	return &stunConn{Conn: conn, pending: make(map[string]chan []byte)}
+}
+
+func (c *stunConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil || !isStunMessage(b[:n]) {
+			return n, err
+		}
+		c.mutex.Lock()
+		if response, ok := c.pending[string(b[8:20])]; ok {
+			select {
+			case response <- append([]byte{}, b[:n]...):
+			default:
+			}
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func isStunMessage(b []byte) bool {
+	return len(b) >= 20 && b[0]&0xc0 == 0 && binary.BigEndian.Uint32(b[4:]) == stunMagicCookie
+}
+
+func newStunTransactionID() []byte {
+	transactionID := make([]byte, 12)
+	rand.Read(transactionID)
+	return transactionID
+}
+
+// stunBindingRequest returns a binding request without attributes. An
+// answer to it is dropped by Read unless keepalive waits for it.
+func stunBindingRequest(transactionID []byte) []byte {
+	request := []byte{0x00, 0x01, 0, 0}
+	request = binary.BigEndian.AppendUint32(request, stunMagicCookie)
+	return append(request, transactionID...)
+}
+
+// keepalive sends a binding request, retransmitted with doubling
+// intervals, and fails if there is no answer within pongTimeout or the
+// mapped address changed since the last one.
+func (c *stunConn) keepalive() error {
+	transactionID := newStunTransactionID()
+	request := stunBindingRequest(transactionID)
+
+	response := make(chan []byte, 1)
+	c.mutex.Lock()
+	c.pending[string(transactionID)] = response
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, string(transactionID))
+		c.mutex.Unlock()
+	}()
+
+	timeout := time.After(pongTimeout)
+	interval := 500 * time.Millisecond
+	for {
+		if _, err := c.Conn.Write(request); err != nil {
+			return err
+		}
+		select {
+		case m := <-response:
+			mapped, err := stunMappedAddress(m)
+			if err != nil {
+				return err
+			}
+			c.mutex.Lock()
+			previous := c.mapped
+			c.mapped = mapped
+			c.mutex.Unlock()
+			if previous != "" && previous != mapped {
+				return errors.New("NAT binding changed from " + previous + " to " + mapped)
+			}
+			return nil
+		case <-time.After(interval):
+			interval *= 2
+		case <-timeout:
+			return errors.New("No STUN response received")
+		}
+	}
+}
+
+// stunMappedAddress reads the (XOR-)MAPPED-ADDRESS of a binding success
+// response.
+func stunMappedAddress(m []byte) (string, error) {
+	if binary.BigEndian.Uint16(m) != 0x0101 {
+		return "", errors.New("STUN binding request failed")
+	}
+	end := 20 + int(binary.BigEndian.Uint16(m[2:]))
+	if end > len(m) {
+		return "", errors.New("STUN response too short")
+	}
+	for off := 20; off+4 <= end; {
+		attributeType := binary.BigEndian.Uint16(m[off:])
+		length := int(binary.BigEndian.Uint16(m[off+2:]))
+		value := m[off+4:]
+		if off+4+length > end {
+			break
+		}
+		value = value[:length]
+		if (attributeType == 0x0020 || attributeType == 0x0001) && length >= 8 {
+			port := binary.BigEndian.Uint16(value[2:])
+			ip := append(net.IP{}, value[4:]...)
+			if attributeType == 0x0020 {
+				port ^= stunMagicCookie >> 16
+				mask := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+				mask = append(mask, m[8:20]...)
+				for i := range ip {
+					ip[i] ^= mask[i]
+				}
+			}
+			return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+		}
+		off += 4 + (length+3)/4*4
+	}
+	return "", errors.New("STUN response without mapped address")
+}
@@ -0,0 +1,306 @@
+package sip
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var outboundInfo = RegisterInfo{
+	Registrar:  Connectinfo{"tcp", "127.0.0.1", 5060},
+	Client:     Connectinfo{"tcp", "127.0.0.1", 5070},
+	Username:   "alice",
+	UserInfo:   UnauthorizedUserInfo("alice"),
+	InstanceID: "urn:uuid:00000000-0000-1000-8000-000a95a0e128",
+	RegID:      1,
+}
+
+// stunResponse returns a binding success response to the request with
+// transactionID, with one address attribute.
+func stunResponse(transactionID []byte, attributeType uint16, ip net.IP, port uint16) []byte {
+	value := []byte{0, 1}
+	if ip.To4() != nil {
+		ip = ip.To4()
+	} else {
+		value[1] = 2
+	}
+	address := append(net.IP{}, ip...)
+	if attributeType == 0x0020 {
+		port ^= stunMagicCookie >> 16
+		mask := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+		mask = append(mask, transactionID...)
+		for i := range address {
+			address[i] ^= mask[i]
+		}
+	}
+	value = binary.BigEndian.AppendUint16(value, port)
+	value = append(value, address...)
+
+	m := []byte{0x01, 0x01}
+	m = binary.BigEndian.AppendUint16(m, uint16(4+len(value)))
+	m = binary.BigEndian.AppendUint32(m, stunMagicCookie)
+	m = append(m, transactionID...)
+	m = binary.BigEndian.AppendUint16(m, attributeType)
+	m = binary.BigEndian.AppendUint16(m, uint16(len(value)))
+	return append(m, value...)
+}
+
+func TestStunMappedAddress(t *testing.T) {
+	transactionID := []byte("0123456789ab")
+	tests := []struct {
+		name     string
+		response []byte
+		expected string
+	}{
+		{"MAPPED-ADDRESS", stunResponse(transactionID, 0x0001, net.ParseIP("192.0.2.1"), 40000), "192.0.2.1:40000"},
+		{"XOR-MAPPED-ADDRESS", stunResponse(transactionID, 0x0020, net.ParseIP("192.0.2.1"), 40000), "192.0.2.1:40000"},
+		{"XOR-MAPPED-ADDRESS IPv6", stunResponse(transactionID, 0x0020, net.ParseIP("2001:db8::1"), 5060), "[2001:db8::1]:5060"},
+	}
+	for _, test := range tests {
+		if mapped, err := stunMappedAddress(test.response); err != nil || mapped != test.expected {
+			t.Errorf("%s: got %s, %v, expected %s", test.name, mapped, err, test.expected)
+		}
+	}
+
+	failed := stunResponse(transactionID, 0x0020, net.ParseIP("192.0.2.1"), 40000)
+	failed[1] = 0x11
+	truncated := stunResponse(transactionID, 0x0020, net.ParseIP("192.0.2.1"), 40000)
+	truncated = truncated[:len(truncated)-4]
+	unknown := stunResponse(transactionID, 0x8022, net.ParseIP("192.0.2.1"), 40000)
+	for _, response := range [][]byte{failed, truncated, unknown} {
+		if mapped, err := stunMappedAddress(response); err == nil {
+			t.Errorf("Got %s from % x", mapped, response)
+		}
+	}
+}
+
+func TestOutboundContactParams(t *testing.T) {
+	info := outboundInfo
+	d := &Dialog{}
+	req := d.createRegister(&info, false)
+	contacts, _ := req.Contacts()
+	if regID, _ := contacts[0].Params.Get("reg-id"); regID != "1" {
+		t.Fatal(req.String())
+	}
+	if instance, _ := contacts[0].Params.Get("+sip.instance"); instance != `"<urn:uuid:00000000-0000-1000-8000-000a95a0e128>"` {
+		t.Fatal(req.String())
+	}
+	if !req.HasOptionTag("Supported", "outbound") || !req.HasOptionTag("Supported", "path") {
+		t.Fatal(req.String())
+	}
+
+	info.RegID = 0
+	req = d.createRegister(&info, false)
+	contacts, _ = req.Contacts()
+	if contacts[0].Params.Has("reg-id") || contacts[0].Params.Has("+sip.instance") || req.HasOptionTag("Supported", "outbound") {
+		t.Fatal(req.String())
+	}
+}
+
+// pipeFlow returns a connection over a pipe as flow of a new outbound
+// registration, and the remote end of the pipe.
+func pipeFlow(t *testing.T, s *SipClient, info *RegisterInfo) (*Registration, *clientConnection, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	conn := newClientConnection(s, CreateDialog(local, s), newConnectionKey("tcp", "127.0.0.1", 5060))
+	t.Cleanup(conn.close)
+	return newRegistration(s, "alice", info), conn, remote
+}
+
+func confirmingResponse(info *RegisterInfo) *Message {
+	d := &Dialog{}
+	req := d.createRegister(info, false)
+	c := CreateResponseTo(&req, 200, "OK")
+	c.AddHeader("Require", "outbound")
+	return &c
+}
+
+func TestFlowRefcount(t *testing.T) {
+	s := CreateClient()
+	info := outboundInfo
+	info.KeepaliveInterval = time.Hour
+	r, conn, _ := pipeFlow(t, &s, &info)
+	users := func() int {
+		conn.mutex.Lock()
+		defer conn.mutex.Unlock()
+		return conn.users
+	}
+
+	// The flow takes over the use of the first REGISTER.
+	conn.acquire()
+	r.useFlow(conn, confirmingResponse(&info))
+	if users() != 1 || !r.isFlow(conn) {
+		t.Fatal("Users after first REGISTER: ", users())
+	}
+	// A refresh reuses the flow and gives its own use back.
+	flow, err := s.registerConnection(context.Background(), r, info.Registrar)
+	if err != nil || flow != conn || users() != 2 {
+		t.Fatal("Refresh not on the flow: ", users())
+	}
+	r.useFlow(conn, confirmingResponse(&info))
+	if users() != 1 {
+		t.Fatal("Users after refresh: ", users())
+	}
+
+	if !r.dropFlow(conn) || r.dropFlow(conn) || r.isFlow(conn) {
+		t.Fatal("Flow dropped twice")
+	}
+	conn.release()
+	if users() != 0 {
+		t.Fatal("Users after drop: ", users())
+	}
+}
+
+func TestWatchFlow(t *testing.T) {
+	defer func(timeout time.Duration) { pongTimeout = timeout }(pongTimeout)
+	pongTimeout = 50 * time.Millisecond
+	s := CreateClient()
+	info := outboundInfo
+	info.KeepaliveInterval = 10 * time.Millisecond
+
+	// The registrar stops answering keepalives.
+	r, conn, remote := pipeFlow(t, &s, &info)
+	pings := make(chan bool, 1)
+	go func(remote net.Conn) {
+		b := make([]byte, 4)
+		if n, _ := remote.Read(b); string(b[:n]) == "\r\n\r\n" {
+			pings <- true
+		}
+		for {
+			if _, err := remote.Read(b); err != nil {
+				return
+			}
+		}
+	}(remote)
+	conn.acquire()
+	r.useFlow(conn, confirmingResponse(&info))
+	select {
+	case <-r.flowFailed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Missing pong not detected")
+	}
+	if len(pings) != 1 || r.isFlow(conn) {
+		t.Fatal("Failed flow kept")
+	}
+	select {
+	case <-conn.closed():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Failed flow not closed")
+	}
+
+	// The registrar closes the flow.
+	closing := outboundInfo
+	closing.KeepaliveInterval = time.Hour
+	r, conn, remote = pipeFlow(t, &s, &closing)
+	conn.acquire()
+	r.useFlow(conn, confirmingResponse(&closing))
+	remote.Close()
+	select {
+	case <-r.flowFailed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Closed flow not detected")
+	}
+}
+
+func TestFlowFailureReregisters(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	registers := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			d := CreateDialog(conn, nil)
+			d.OnMessage(func(m *Message) {
+				c := CreateResponseTo(m, 200, "OK")
+				c.AddHeader("Require", "outbound")
+				c.SetExpires(300)
+				d.sendMessage(&c)
+				registers <- conn
+			})
+		}
+	}()
+
+	s := CreateClient()
+	defer s.Shutdown()
+	info := outboundInfo
+	info.Registrar.Port = l.Addr().(*net.TCPAddr).Port
+	info.KeepaliveInterval = time.Hour
+	r, err := s.Register(context.Background(), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-registers
+	first.Close()
+	select {
+	case second := <-registers:
+		if second == first {
+			t.Fatal("Registered again on the failed flow")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No REGISTER after the flow failed")
+	}
+	for _, expected := range []RegistrationState{REGISTERING, REGISTERED, REGISTERING, REGISTERED} {
+		select {
+		case event := <-r.Changes():
+			if event.State != expected {
+				t.Fatal("Got ", event.State, ", expected ", expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("No ", expected)
+		}
+	}
+}
+
+func TestUdpKeepalive(t *testing.T) {
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	requests := make(chan []byte, 4)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := peer.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			requests <- append([]byte{}, b[:n]...)
+			if isStunMessage(b[:n]) {
+				peer.WriteTo(stunResponse(b[8:20], 0x0020, net.ParseIP("192.0.2.1"), 40000), addr)
+			}
+		}
+	}()
+
+	s := CreateClient()
+	defer s.Shutdown()
+	conn, err := s.dial(context.Background(), Connectinfo{"udp", "127.0.0.1", peer.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.release()
+	for _, confirmed := range []bool{false, true} {
+		if err := conn.keepalive(confirmed); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case request := <-requests:
+			if !isStunMessage(request) {
+				t.Fatalf("Keepalive %q is no STUN binding request", request)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("No keepalive sent")
+		}
+	}
+	if mapped := conn.dialog.Conn.(*stunConn).mapped; mapped != "192.0.2.1:40000" {
+		t.Fatal(mapped)
+	}
+}
@@ -2,9 +2,16 @@ package sip
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"log"
 )
@@ -18,91 +25,408 @@ const (
 )
 
 type Parser struct {
-	state     bool
 	reader    io.Reader
 	bufReader *bufio.Reader
+	limits    ParserLimits
 
-	callback Callback
+	windowStart       time.Time
+	windowCount       int
+	callback          Callback
+	errorCallback     ErrorCallback
+	keepaliveCallback KeepaliveCallback
+	done              chan struct{}
+
+	// callbackMutex guards the callbacks, which may be replaced while
+	// parsing.
+	callbackMutex sync.Mutex
+}
+
+// ParserLimits protect a Parser against peers sending oversized or too
+// many messages. A zero value disables the respective limit.
+type ParserLimits struct {
+	MaxLineLength        int
+	MaxHeaders           int
+	MaxBodySize          int
+	MaxMessagesPerSecond int
+}
+
+var DefaultParserLimits = ParserLimits{
+	MaxLineLength:        8192,
+	MaxHeaders:           256,
+	MaxBodySize:          1 << 20,
+	MaxMessagesPerSecond: 200,
+}
+
+// LimitError is reported when a peer exceeds one of the ParserLimits.
+// Code is the status code to reject the message with, Message the part
+// of the message read so far, if any. Parsing stops after a LimitError.
+type LimitError struct {
+	Code    int
+	Limit   string
+	Message *Message
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%d %s: %s exceeded", e.Code, ReasonPhrase(e.Code), e.Limit)
 }
 
 type Callback func(*Message)
 
+// KeepaliveCallback is called for CRLF keepalives between messages (RFC
+// 5626, section 3.5.1). ping is true for a double CRLF arriving at once,
+// false for a single CRLF, e.g. a pong.
+type KeepaliveCallback func(ping bool)
+
+// ErrorCallback receives parse errors. Errors of type *ParseError refer to
+// a single message and parsing continues; any other error ends parsing.
+type ErrorCallback func(error)
+
 func NewParser(reader io.Reader) *Parser {
 	p := &Parser{}
-	p.state = false
 	p.reader = reader
 	p.bufReader = bufio.NewReader(p.reader)
+	p.limits = DefaultParserLimits
+	p.done = make(chan struct{})
 
 	return p
 }
 
+func (p *Parser) SetLimits(limits ParserLimits) {
+	p.limits = limits
+}
+
 func (p *Parser) SetCallback(newCallback Callback) {
+	p.callbackMutex.Lock()
+	defer p.callbackMutex.Unlock()
 	p.callback = newCallback
 }
 
+func (p *Parser) SetErrorCallback(newCallback ErrorCallback) {
+	p.callbackMutex.Lock()
+	defer p.callbackMutex.Unlock()
+	p.errorCallback = newCallback
+}
+
+func (p *Parser) SetKeepaliveCallback(newCallback KeepaliveCallback) {
+	p.callbackMutex.Lock()
+	defer p.callbackMutex.Unlock()
+	p.keepaliveCallback = newCallback
+}
+
 func (p *Parser) StartParsing() {
 	go p.parse()
 }
 
+// Done is closed when parsing stopped, e.g. because the connection was
+// closed.
+func (p *Parser) Done() <-chan struct{} {
+	return p.done
+}
+
 func (p *Parser) parse() {
-	go func() {
-		state := FIRST_LINE // 0 = first line, 1 = headers, 2 = content
-		var message Message
-		var toRead int
-		for {
-			switch state {
-			case FIRST_LINE:
-				line, err := Readln(p.bufReader)
-				if err != nil {
-					log.Println("Error: ", err)
-				}
-				elements := strings.Split(line, " ")
-				if elements[0] == "SIP/2.0" {
-					code, err := strconv.Atoi(elements[1])
-					if err != nil {
-						log.Println("Error. Code was " + elements[1] + ". Attempt to continue")
-						code = 400
-					}
-					reply := elements[2]
-					message = CreateResponse(code, reply)
-				} else {
-					method := elements[0]
-					uri := elements[1]
-					message = CreateRequest(method, uri)
-				}
-				state = HEADERS
-			case HEADERS:
-				line, err := Readln(p.bufReader)
-				if err != nil {
-					log.Println("Error: ", err)
-				}
-				if line == "" {
-					state = BODY
-					continue
-				}
+	defer close(p.done)
+	for {
+		data, err := p.readMessage()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				p.fail(err)
+			}
+			return
+		}
+		if err := p.countMessage(data); err != nil {
+			p.fail(err)
+			return
+		}
+		message, err := ParseMessage(data)
+		if err != nil {
+			p.fail(err)
+			continue
+		}
+		p.callbackMutex.Lock()
+		callback := p.callback
+		p.callbackMutex.Unlock()
+		if callback != nil {
+			callback(message)
+		}
+	}
+}
+
+func (p *Parser) fail(err error) {
+	p.callbackMutex.Lock()
+	errorCallback := p.errorCallback
+	p.callbackMutex.Unlock()
+	if errorCallback != nil {
+		errorCallback(err)
+		return
+	}
+	log.Println("Error: ", err)
+}
+
+func (p *Parser) countMessage(data []byte) error {
+	if p.limits.MaxMessagesPerSecond <= 0 {
+		return nil
+	}
+	now := time.Now()
+	if now.Sub(p.windowStart) >= time.Second {
+		p.windowStart = now
+		p.windowCount = 0
+	}
+	p.windowCount++
+	if p.windowCount > p.limits.MaxMessagesPerSecond {
+		return &LimitError{503, "Message rate", partialMessage(data)}
+	}
+	return nil
+}
 
-				headerLine := strings.Split(line, ": ")
-				headerName := headerLine[0]
-				headerValue := headerLine[1]
-				if headerName == "Content-Length" {
-					toRead, _ = strconv.Atoi(headerValue)
+func (p *Parser) readLine() (string, error) {
+	var (
+		isPrefix bool  = true
+		err      error = nil
+		line, ln []byte
+	)
+	for isPrefix && err == nil {
+		line, isPrefix, err = p.bufReader.ReadLine()
+		ln = append(ln, line...)
+		if p.limits.MaxLineLength > 0 && len(ln) > p.limits.MaxLineLength {
+			return "", &LimitError{513, "Line length", nil}
+		}
+	}
+	return string(ln), err
+}
+
+// readMessage reads the next message off the stream, framed by its
+// Content-Length. Empty lines in front of a message are skipped.
+func (p *Parser) readMessage() ([]byte, error) {
+	var data bytes.Buffer
+	state := FIRST_LINE
+	toRead := 0
+	numHeaders := 0
+	for {
+		switch state {
+		case FIRST_LINE:
+			line, err := p.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if line == "" {
+				p.keepalive()
+				continue
+			}
+			data.WriteString(line + "\r\n")
+			state = HEADERS
+		case HEADERS:
+			line, err := p.readLine()
+			if limitErr, ok := err.(*LimitError); ok {
+				limitErr.Message = partialMessage(data.Bytes())
+				return nil, limitErr
+			}
+			if err != nil {
+				return nil, err
+			}
+			if line == "" {
+				data.WriteString("\r\n")
+				state = BODY
+				continue
+			}
+			numHeaders++
+			if p.limits.MaxHeaders > 0 && numHeaders > p.limits.MaxHeaders {
+				return nil, &LimitError{513, "Header count", partialMessage(data.Bytes())}
+			}
+			data.WriteString(line + "\r\n")
+			headerName, headerValue, err := parseHeaderLine(line)
+			if err == nil && headerName == "Content-Length" {
+				toRead, err = strconv.Atoi(headerValue)
+				if err != nil || toRead < 0 {
+					return nil, errors.New("Cannot frame message, invalid Content-Length: " + headerValue)
 				}
-				message.Headers.AddHeader(headerName, headerValue)
-			case BODY:
-				if toRead > 0 {
-					crtByte, err := p.bufReader.ReadByte()
-					if err != nil {
-						log.Println("Error: ", err)
-					}
-					message.Body = append(message.Body, crtByte)
-					toRead--
-				} else {
-					p.callback(&message)
-					state = FIRST_LINE
+				if p.limits.MaxBodySize > 0 && toRead > p.limits.MaxBodySize {
+					return nil, &LimitError{413, "Body size", partialMessage(data.Bytes())}
 				}
+			}
+		case BODY:
+			body := make([]byte, toRead)
+			if _, err := io.ReadFull(p.bufReader, body); err != nil {
+				return nil, err
+			}
+			data.Write(body)
+			return data.Bytes(), nil
+		}
+	}
+}
+
+// keepalive reports an empty line read between messages.
+func (p *Parser) keepalive() {
+	ping := false
+	if p.bufReader.Buffered() >= 2 {
+		if next, _ := p.bufReader.Peek(2); string(next) == "\r\n" {
+			p.bufReader.Discard(2)
+			ping = true
+		}
+	}
+	p.callbackMutex.Lock()
+	keepaliveCallback := p.keepaliveCallback
+	p.callbackMutex.Unlock()
+	if keepaliveCallback != nil {
+		keepaliveCallback(ping)
+	}
+}
+
+// partialMessage parses the incomplete message read so far, so that it
+// can be rejected with a response.
+func partialMessage(data []byte) *Message {
+	head, _, found := splitHeaderSection(data)
+	if found {
+		data = head
+	}
+	message, err := ParseMessage(append(append([]byte{}, data...), "\r\n\r\n"...))
+	if parseErr, ok := err.(*ParseError); ok {
+		return parseErr.Message
+	}
+	return message
+}
+
+// ParseMessage parses a single, complete SIP message from data.
+// The body is cut to Content-Length if the header is present,
+// otherwise everything after the header section is taken as body.
+// Errors are of type *ParseError.
+func ParseMessage(data []byte) (*Message, error) {
+	head, body, found := splitHeaderSection(data)
+	if !found {
+		return nil, newParseError(0, "No end of header section")
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 {
+		return nil, newParseError(0, "Empty message")
+	}
+
+	message, err := parseHeadline(lines[0])
+	if message == nil {
+		return nil, err
+	}
+
+	for _, line := range unfoldHeaderLines(lines[1:]) {
+		headerName, headerValue, headerErr := parseHeaderLine(line)
+		if headerErr != nil {
+			if err == nil {
+				err = headerErr
+			}
+			continue
+		}
+		message.Headers.AddHeader(headerName, headerValue)
+	}
 
+	contentLengths := message.Headers.FindHeadersByName("Content-Length")
+	if len(contentLengths) == 1 {
+		length, lengthErr := strconv.Atoi(contentLengths[0].Value)
+		switch {
+		case lengthErr != nil || length < 0 || !isDigits(contentLengths[0].Value):
+			if err == nil {
+				err = newParseError(400, "Invalid Content-Length: "+contentLengths[0].Value)
+			}
+		case length > len(body):
+			if err == nil {
+				err = newParseError(400, "Body shorter than Content-Length")
 			}
+		default:
+			body = body[:length]
+		}
+	}
+	message.Body = append([]byte{}, body...)
+
+	if err == nil {
+		err = message.Validate()
+	}
+	if err != nil {
+		parseErr, ok := err.(*ParseError)
+		if !ok {
+			parseErr = newParseError(400, err.Error())
+		}
+		if message.GetType() == RESPONSE {
+			parseErr.Code = 0
+		}
+		parseErr.Message = message
+		return nil, parseErr
+	}
+	return message, nil
+}
+
+func splitHeaderSection(data []byte) (head []byte, body []byte, found bool) {
+	crlf := bytes.Index(data, []byte("\r\n\r\n"))
+	lf := bytes.Index(data, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return data[:crlf], data[crlf+4:], true
+	case lf >= 0:
+		return data[:lf], data[lf+2:], true
+	}
+	return nil, nil, false
+}
+
+func unfoldHeaderLines(lines []string) []string {
+	var unfolded []string
+	for _, line := range lines {
+		if len(unfolded) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			unfolded[len(unfolded)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		unfolded = append(unfolded, line)
+	}
+	return unfolded
+}
+
+var sipVersion = regexp.MustCompile(`^SIP/[0-9]+\.[0-9]+$`)
 
+// parseHeadline returns the message started by line. For malformed
+// request lines a request is still returned along with the error, so
+// that the caller can answer it.
+func parseHeadline(line string) (*Message, error) {
+	if strings.HasPrefix(line, "SIP/") {
+		elements := strings.SplitN(line, " ", 3)
+		if len(elements) < 3 || elements[0] != "SIP/"+sipversion {
+			return nil, newParseError(0, "Malformed status line: "+line)
 		}
-	}()
+		code, err := strconv.Atoi(elements[1])
+		if err != nil || len(elements[1]) != 3 || code < 100 || code > 699 {
+			return nil, newParseError(0, "Malformed status code: "+elements[1])
+		}
+		message := CreateResponse(code, elements[2])
+		return &message, nil
+	}
+
+	elements := strings.Split(line, " ")
+	if len(elements) < 2 {
+		return nil, newParseError(400, "Malformed request line: "+line)
+	}
+	message := CreateRequest(elements[0], elements[1])
+	switch {
+	case len(elements) != 3:
+		return &message, newParseError(400, "Malformed request line: "+line)
+	case !isToken(elements[0]):
+		return &message, newParseError(400, "Invalid method: "+elements[0])
+	case !sipVersion.MatchString(elements[2]):
+		return &message, newParseError(400, "Malformed version: "+elements[2])
+	}
+	if _, err := ParseUri(elements[1]); err != nil {
+		return &message, newParseError(400, "Malformed Request-URI: "+err.Error())
+	}
+	headline := message.Headline.(RequestHeadline)
+	headline.Version = elements[2]
+	message.Headline = headline
+	return &message, nil
+}
+
+func parseHeaderLine(line string) (name string, value string, err error) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return "", "", newParseError(400, "Malformed header line: "+line)
+	}
+	name = strings.TrimSpace(line[:colon])
+	if !isToken(name) {
+		return "", "", newParseError(400, "Invalid header name: "+name)
+	}
+	return canonicalHeaderName(name), strings.TrimSpace(line[colon+1:]), nil
 }
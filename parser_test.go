@@ -0,0 +1,141 @@
+package sip
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTortureMessages parses the RFC 4475 messages listed in
+// testdata/rfc4475/expected.txt and checks that each is accepted or
+// rejected as expected.
+func TestTortureMessages(t *testing.T) {
+	manifest, err := os.Open(filepath.Join("testdata", "rfc4475", "expected.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest.Close()
+
+	tested := 0
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			t.Fatalf("Malformed line in expected.txt: %q", scanner.Text())
+		}
+		name, expected := fields[0], fields[1]
+		tested++
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "rfc4475", name+".sip"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := ParseMessage(data)
+			got := "valid"
+			if err != nil {
+				parseErr, ok := err.(*ParseError)
+				if !ok {
+					t.Fatalf("Unexpected error type %T: %v", err, err)
+				}
+				got = "invalid"
+				if parseErr.Code != 0 {
+					got = strconv.Itoa(parseErr.Code)
+				}
+			}
+			if got != expected {
+				t.Fatalf("Got %s, expected %s (%v)", got, expected, err)
+			}
+			if m == nil {
+				return
+			}
+			// Accepted messages survive a round trip.
+			out, err := m.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParseMessage(out); err != nil {
+				t.Fatalf("Round trip failed: %v", err)
+			}
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "rfc4475", "*.sip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tested != len(files) {
+		t.Fatalf("expected.txt lists %d messages, testdata has %d", tested, len(files))
+	}
+}
+
+func limitTestRequest(headers int, contentLength int) string {
+	m := "OPTIONS sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP 192.0.2.1;branch=z9hG4bK" + RandSeq(8) + "\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:bob@example.com>\r\n" +
+		"Call-ID: " + RandSeq(8) + "\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		"Max-Forwards: 70\r\n"
+	for i := 0; i < headers; i++ {
+		m += "X-Extra: " + strconv.Itoa(i) + "\r\n"
+	}
+	return m + "Content-Length: " + strconv.Itoa(contentLength) + "\r\n\r\n" + strings.Repeat("x", contentLength)
+}
+
+// TestParserLimits sends input exceeding the limits to a dialog and
+// checks the rejection and that the connection is closed.
+func TestParserLimits(t *testing.T) {
+	limits := ParserLimits{MaxLineLength: 200, MaxHeaders: 20, MaxBodySize: 100, MaxMessagesPerSecond: 2}
+	tests := []struct {
+		name  string
+		input string
+		code  int
+	}{
+		{"line length", strings.Replace(limitTestRequest(0, 0), "Max-Forwards: 70", "Subject: "+strings.Repeat("a", 300), 1), 513},
+		{"header count", limitTestRequest(20, 0), 513},
+		{"body size", limitTestRequest(0, 101), 413},
+		{"message rate", limitTestRequest(0, 0) + limitTestRequest(0, 0) + limitTestRequest(0, 0), 503},
+		// Without a request line there is nothing to answer.
+		{"request line length", "OPTIONS sip:" + strings.Repeat("a", 300) + "@example.com SIP/2.0\r\n", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			s := CreateClient()
+			s.Limits = limits
+			CreateDialog(remote, &s)
+
+			responses := make(chan *Message, 4)
+			p := NewParser(local)
+			p.SetCallback(func(m *Message) { responses <- m })
+			p.StartParsing()
+			go local.Write([]byte(test.input))
+
+			select {
+			case <-p.Done():
+			case <-time.After(2 * time.Second):
+				t.Fatal("Connection not closed")
+			}
+			close(responses)
+			var codes []int
+			for m := range responses {
+				codes = append(codes, m.Headline.(ResponseHeadline).Code)
+			}
+			if test.code == 0 && len(codes) != 0 || test.code != 0 && (len(codes) != 1 || codes[0] != test.code) {
+				t.Fatalf("Got responses %v, expected %d", codes, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,686 @@
+package sip
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RingingTimeout bounds how long a proxy waits for the final response to
+// an INVITE after a provisional one (Timer C, RFC 3261, section 16.6,
+// step 11). It must be more than 3 minutes.
+var RingingTimeout = 3*time.Minute + 30*time.Second
+
+// Target is a destination a proxy forwards a request to. Q orders the
+// targets for SEQUENTIAL forking, the highest first.
+type Target struct {
+	Uri SipUri
+	Q   float64
+}
+
+// RouteFunc returns the targets a request is forwarded to. It takes
+// precedence over the location lookup of a Proxy.
+type RouteFunc func(req *Message) ([]Target, error)
+
+type ForkMode int
+
+const (
+	// PARALLEL forwards to all targets at once.
+	PARALLEL ForkMode = iota
+	// SEQUENTIAL tries the targets by descending q, targets with the same
+	// q in parallel, until one answers with 2xx or 6xx.
+	SEQUENTIAL
+)
+
+// Proxy forwards requests received by a SipClient (RFC 3261, section 16).
+// Requests for one of Domains are forwarded to the bindings found in
+// Locations, all others to their Request-URI. A stateless proxy forwards
+// each request to its first target and relays all responses. A stateful
+// proxy forks the request according to Forking and relays provisional
+// responses, every 2xx and the best final response. Once a branch
+// answers with 2xx or 6xx, pending INVITE branches are cancelled.
+type Proxy struct {
+	// Connectinfo is our own address, as put in Via and Record-Route.
+	Connectinfo
+	Stateful    bool
+	RecordRoute bool
+	Forking     ForkMode
+	Domains     []string
+	Locations   LocationStore
+	Router      RouteFunc
+
+	// BranchTimeout, if set, bounds each branch of a stateful proxy,
+	// after which it is cancelled and counts as 408. Otherwise a branch
+	// times out after TransactionTimeout without response, and an INVITE
+	// branch after RingingTimeout since its last provisional response.
+	BranchTimeout time.Duration
+
+	client       *SipClient
+	mutex        sync.Mutex
+	transactions map[string]*proxyTransaction
+}
+
+// proxyTransaction is the server transaction of a request forwarded
+// statefully.
+type proxyTransaction struct {
+	request  *Message
+	upstream *Dialog
+
+	mutex     sync.Mutex
+	final     int
+	cancelled bool
+	branches  []*proxyBranch
+}
+
+// proxyBranch is a client transaction of a proxyTransaction.
+type proxyBranch struct {
+	forwarded *Message
+
+	mutex       sync.Mutex
+	conn        *clientConnection
+	provisional bool
+	cancelled   bool
+	done        bool
+}
+
+func NewProxy(client *SipClient, host string, port int) *Proxy {
+	return &Proxy{
+		Connectinfo:  Connectinfo{"tcp", host, port},
+		Stateful:     true,
+		client:       client,
+		transactions: make(map[string]*proxyTransaction),
+	}
+}
+
+// HandleRequest forwards req, received on upstream, or rejects it.
+func (p *Proxy) HandleRequest(upstream *Dialog, req *Message) {
+	request := req.Headline.(RequestHeadline)
+	reply := func(code int) {
+		if request.Method != "ACK" {
+			c := CreateResponseTo(req, code, ReasonPhrase(code))
+			upstream.sendMessage(&c)
+		}
+	}
+
+	if request.Method == "ACK" && p.absorbAck(req) {
+		return
+	}
+	if request.Method == "CANCEL" && p.Stateful {
+		if t := p.transaction(topBranch(req)); t != nil {
+			reply(200)
+			t.cancel()
+			return
+		}
+	}
+	maxForwards, err := req.GetMaxForwards()
+	if err != nil {
+		maxForwards = 70
+	}
+	if maxForwards == 0 {
+		reply(483)
+		return
+	}
+	// The branches are derived from the request as received, before its
+	// route is processed, so that a loop is recognized with the same hash.
+	hash := p.loopHash(req)
+	if p.isLoop(req, hash) {
+		reply(482)
+		return
+	}
+	p.preprocessRoutes(req)
+	if request.Method == "OPTIONS" && p.isForProxy(req) {
+		p.client.answerOptions(upstream, req)
+		return
+	}
+
+	targets, err := p.targets(req)
+	if err != nil {
+		log.Println("Error routing ", request.Uri.String(), ": ", err)
+		reply(500)
+		return
+	}
+	if len(targets) == 0 {
+		reply(404)
+		return
+	}
+
+	markReceived(upstream, req)
+	if !p.Stateful || request.Method == "ACK" || request.Method == "CANCEL" {
+		p.forwardStateless(upstream, req, hash, targets[0].Uri, maxForwards-1)
+		return
+	}
+	go p.forwardStateful(upstream, req, hash, targets, maxForwards-1)
+}
+
+func (p *Proxy) targets(req *Message) ([]Target, error) {
+	if p.Router != nil {
+		return p.Router(req)
+	}
+	uri := req.Headline.(RequestHeadline).Uri
+	if p.Locations == nil || !p.isLocalDomain(uri.Host) {
+		return []Target{{uri, 1}}, nil
+	}
+	bindings, err := p.Locations.Lookup(addressOfRecord(uri))
+	if err != nil {
+		return nil, err
+	}
+	var targets []Target
+	for _, binding := range bindings {
+		targets = append(targets, Target{binding.Contact.Uri, binding.Q})
+	}
+	return targets, nil
+}
+
+// forkGroups splits targets into the groups tried one after the other.
+func (p *Proxy) forkGroups(targets []Target) [][]Target {
+	if p.Forking != SEQUENTIAL {
+		return [][]Target{targets}
+	}
+	sorted := append([]Target{}, targets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Q > sorted[j].Q
+	})
+	var groups [][]Target
+	for i, target := range sorted {
+		if i == 0 || target.Q != sorted[i-1].Q {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], target)
+	}
+	return groups
+}
+
+func (p *Proxy) isLocalDomain(host string) bool {
+	for _, domain := range p.Domains {
+		if sameHost(domain, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// loopHash identifies a request independently of the proxies it passed,
+// so that it can be recognized when it comes back (RFC 3261, section
+// 16.6, step 8). It is the same for an INVITE and its CANCEL.
+func (p *Proxy) loopHash(req *Message) string {
+	from, _ := req.FromAddress()
+	to, _ := req.ToAddress()
+	cseq, _ := req.GetCSeq()
+	key := fmt.Sprintf("%s %s %s %s %d", req.Headline.(RequestHeadline).Uri.String(), from.Tag(), to.Tag(), req.GetCallId(), cseq)
+	return fmt.Sprintf("%x", md5.Sum([]byte(key)))[:10]
+}
+
+// isLoop tells whether req already passed this proxy unchanged. A
+// request which passed with a different Request-URI is spiralling,
+// which is allowed.
+func (p *Proxy) isLoop(req *Message, hash string) bool {
+	prefix := "z9hG4bK" + hash + "."
+	vias, _ := req.Vias()
+	for _, via := range vias {
+		if p.isOwnVia(via) && strings.HasPrefix(via.Branch(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) isOwnVia(via Via) bool {
+	return sameHost(via.Host, p.Host) && via.Port == p.Port
+}
+
+// preprocessRoutes removes this proxy from the route of req (RFC 3261,
+// section 16.4). If the previous hop was a strict router, the
+// Request-URI is our Record-Route entry and the original one is restored
+// from the last Route.
+func (p *Proxy) preprocessRoutes(req *Message) {
+	request := req.Headline.(RequestHeadline)
+	routes, err := req.Routes()
+	if err != nil {
+		return
+	}
+	if p.isOwnRoute(request.Uri) && len(routes) > 0 {
+		req.Headline = CreateRequestHeadline(request.Method, routes[len(routes)-1].Uri, request.Version)
+		routes = routes[:len(routes)-1]
+		req.SetRoutes(routes)
+	}
+	if len(routes) > 0 && p.isOwnRoute(routes[0].Uri) {
+		req.SetRoutes(routes[1:])
+	}
+}
+
+// isOwnRoute tells whether uri is the Record-Route entry of this proxy.
+func (p *Proxy) isOwnRoute(uri SipUri) bool {
+	port := uri.Port
+	if port == 0 {
+		port = 5060
+	}
+	return uri.User == "" && sameHost(uri.Host, p.Host) && port == p.Port
+}
+
+// isForProxy tells whether req is addressed to the proxy itself rather
+// than to be forwarded, e.g. an OPTIONS checking that it is alive.
+func (p *Proxy) isForProxy(req *Message) bool {
+	uri := req.Headline.(RequestHeadline).Uri
+	routes, _ := req.Routes()
+	return len(routes) == 0 && uri.User == "" && (p.isOwnRoute(uri) || p.isLocalDomain(uri.Host))
+}
+
+// prepare builds the copy of req forwarded to target and returns the URI
+// of the next hop: the next loose route, or the Request-URI. The branch only
+// depends on the loop hash of req and target, so that a CANCEL takes the
+// same branch as the request it cancels.
+func (p *Proxy) prepare(req *Message, hash string, target SipUri, maxForwards int) (Message, SipUri) {
+	request := req.Headline.(RequestHeadline)
+	c := req.Clone()
+	routes, _ := c.Routes()
+	hop := applyRoutes(&c, target, routes)
+	c.SetMaxForwards(maxForwards)
+	if p.RecordRoute && request.Method != "REGISTER" {
+		c.Headers.PrependHeader("Record-Route", "<"+looseRoute(p.Connectinfo).String()+">")
+	}
+	branch := fmt.Sprintf("z9hG4bK%s.%x", hash, md5.Sum([]byte(topBranch(req)+" "+target.String())))
+	via := Via{"SIP", "2.0", strings.ToUpper(p.Transport), p.Host, p.Port, Params{{"branch", branch}}}
+	c.Headers.PrependHeader("Via", via.String())
+	return c, hop
+}
+
+// destinationOf returns where requests for uri are sent, without DNS
+// lookups. See SipClient.Locate for RFC 3263 resolution.
+func destinationOf(uri SipUri) Connectinfo {
+	transport, ok := uri.Params.Get("transport")
+	if !ok {
+		transport = "tcp"
+	}
+	port := uri.Port
+	if port == 0 {
+		port = 5060
+	}
+	return Connectinfo{strings.ToLower(transport), uri.Host, port}
+}
+
+// markReceived adds the source address of req to its top Via as received
+// and rport (RFC 3261, section 18.2.1 and RFC 3581), so that responses
+// relayed statelessly find the connection it came in on.
+func markReceived(upstream *Dialog, req *Message) {
+	host, port, err := net.SplitHostPort(upstream.Conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	req.SetTopViaParam("received", host)
+	req.SetTopViaParam("rport", port)
+}
+
+// viaDestination returns where a response is sent to reach the element
+// which added via: its received and rport if set, its sent-by otherwise.
+func viaDestination(via Via) Connectinfo {
+	dest := Connectinfo{strings.ToLower(via.Transport), via.Host, via.Port}
+	if received, ok := via.Params.Get("received"); ok && received != "" {
+		dest.Host = received
+	}
+	if rport, ok := via.Params.Get("rport"); ok {
+		if port, err := strconv.Atoi(rport); err == nil {
+			dest.Port = port
+		}
+	}
+	if dest.Port == 0 {
+		dest.Port = defaultPort(dest.Transport)
+	}
+	return dest
+}
+
+// relayResponse forwards a response which matches no transaction along
+// its Via path (RFC 3261, sections 16.7, 16.11 and 18.2.2). The connection
+// the request came in on is reused if it is still open.
+func (p *Proxy) relayResponse(m *Message) {
+	if p.isBranchResponse(m) {
+		// A late response of a cancelled or timed out branch, or the
+		// response to its CANCEL, ends at the proxy.
+		return
+	}
+	if !p.toUpstream(m) {
+		log.Println("Dropping response not sent by us: ", m.Headline.ToString())
+		return
+	}
+	vias, err := m.Vias()
+	if err != nil || len(vias) == 0 {
+		return
+	}
+	dest := viaDestination(vias[0])
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TransactionTimeout)
+		defer cancel()
+		conn, err := p.client.dial(ctx, dest)
+		if err != nil {
+			log.Println("Error relaying response to ", dest.Host, ": ", err)
+			return
+		}
+		defer conn.release()
+		conn.send(m)
+	}()
+}
+
+// toUpstream removes our Via from a response received downstream. It
+// returns false for responses not sent to us.
+func (p *Proxy) toUpstream(m *Message) bool {
+	via, err := m.PopVia()
+	if err != nil || !p.isOwnVia(via) {
+		return false
+	}
+	_, err = m.Headers.FindHeaderByName("Via")
+	return err == nil
+}
+
+// forwardStateless sends req to target without keeping state. The
+// responses match no transaction and are relayed by relayResponse.
+func (p *Proxy) forwardStateless(upstream *Dialog, req *Message, hash string, target SipUri, maxForwards int) {
+	method := req.Headline.(RequestHeadline).Method
+	forwarded, hop := p.prepare(req, hash, target, maxForwards)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TransactionTimeout)
+		defer cancel()
+		conn, err := p.client.dialUri(ctx, hop)
+		if err != nil {
+			log.Println("Error forwarding to ", target.String(), ": ", err)
+			if method != "ACK" {
+				c := CreateResponseTo(req, 503, ReasonPhrase(503))
+				upstream.sendMessage(&c)
+			}
+			return
+		}
+		defer conn.release()
+		conn.send(&forwarded)
+	}()
+}
+
+func (p *Proxy) forwardStateful(upstream *Dialog, req *Message, hash string, targets []Target, maxForwards int) {
+	method := req.Headline.(RequestHeadline).Method
+	t := p.newTransaction(upstream, req)
+	defer p.forget(t)
+	if method == "INVITE" {
+		c := CreateResponseTo(req, 100, ReasonPhrase(100))
+		upstream.sendMessage(&c)
+	}
+
+	var finals []*Message
+	answered := false
+	for _, group := range p.forkGroups(targets) {
+		if t.isCancelled() {
+			break
+		}
+		results := make(chan *Message, len(group))
+		for _, target := range group {
+			forwarded, hop := p.prepare(req, hash, target.Uri, maxForwards)
+			b := t.addBranch(&forwarded)
+			go func() {
+				results <- p.forwardBranch(t, b, hop)
+			}()
+		}
+
+		for range group {
+			m := <-results
+			code := m.Headline.(ResponseHeadline).Code
+			if code >= 300 {
+				finals = append(finals, m)
+				if code >= 600 {
+					t.cancel()
+				}
+				continue
+			}
+			// Every 2xx to an INVITE is relayed, as each may establish a
+			// dialog.
+			if method == "INVITE" || !answered {
+				p.respond(t, m)
+				answered = true
+			}
+			t.cancel()
+		}
+		if answered {
+			return
+		}
+	}
+	best := bestResponse(finals)
+	if best == nil {
+		// Cancelled before any branch was tried.
+		c := CreateResponseTo(req, 487, ReasonPhrase(487))
+		best = &c
+	}
+	p.respond(t, best)
+}
+
+// forwardBranch sends the request of b to hop and returns the final
+// response for upstream. Provisional responses other than 100 are
+// relayed.
+func (p *Proxy) forwardBranch(t *proxyTransaction, b *proxyBranch, hop SipUri) *Message {
+	synthesize := func(code int) *Message {
+		c := CreateResponseTo(t.request, code, ReasonPhrase(code))
+		return &c
+	}
+	defer b.finish()
+	ctx := context.Background()
+	if p.BranchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.BranchTimeout)
+		defer cancel()
+	}
+	dialCtx, cancelDial := context.WithTimeout(ctx, TransactionTimeout)
+	defer cancelDial()
+	conn, err := p.client.dialUri(dialCtx, hop)
+	if err != nil {
+		log.Println("Error forwarding to ", hop.String(), ": ", err)
+		return synthesize(503)
+	}
+	defer conn.release()
+	if !b.start(conn) {
+		return synthesize(487)
+	}
+
+	m, err := conn.transact(ctx, b.forwarded, func(m *Message) {
+		b.onProvisional()
+		if m.Headline.(ResponseHeadline).Code > 100 && p.toUpstream(m) {
+			t.upstream.sendMessage(m)
+		}
+	}, RingingTimeout)
+	if err != nil {
+		b.cancel()
+		return synthesize(408)
+	}
+	if !p.toUpstream(m) {
+		return synthesize(502)
+	}
+	return m
+}
+
+// isBranchResponse tells whether m answers a branch of a stateful
+// transaction.
+func (p *Proxy) isBranchResponse(m *Message) bool {
+	branch := topBranch(m)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, t := range p.transactions {
+		t.mutex.Lock()
+		for _, b := range t.branches {
+			if topBranch(b.forwarded) == branch {
+				t.mutex.Unlock()
+				return true
+			}
+		}
+		t.mutex.Unlock()
+	}
+	return false
+}
+
+func (p *Proxy) newTransaction(upstream *Dialog, req *Message) *proxyTransaction {
+	t := &proxyTransaction{request: req, upstream: upstream}
+	p.mutex.Lock()
+	p.transactions[topBranch(req)] = t
+	p.mutex.Unlock()
+	return t
+}
+
+func (p *Proxy) transaction(branch string) *proxyTransaction {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.transactions[branch]
+}
+
+// forget drops t once retransmissions and the ACK of a non-2xx response
+// are over.
+func (p *Proxy) forget(t *proxyTransaction) {
+	branch := topBranch(t.request)
+	time.AfterFunc(TransactionTimeout, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if p.transactions[branch] == t {
+			delete(p.transactions, branch)
+		}
+	})
+}
+
+// respond sends a final response upstream.
+func (p *Proxy) respond(t *proxyTransaction, m *Message) {
+	t.mutex.Lock()
+	t.final = m.Headline.(ResponseHeadline).Code
+	t.mutex.Unlock()
+	t.upstream.sendMessage(m)
+}
+
+// absorbAck tells whether ack acknowledges a non-2xx response of ours,
+// which ends at this proxy.
+func (p *Proxy) absorbAck(ack *Message) bool {
+	t := p.transaction(topBranch(ack))
+	if t == nil {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.final >= 300
+}
+
+func (t *proxyTransaction) addBranch(forwarded *Message) *proxyBranch {
+	b := &proxyBranch{forwarded: forwarded}
+	t.mutex.Lock()
+	t.branches = append(t.branches, b)
+	t.mutex.Unlock()
+	return b
+}
+
+func (t *proxyTransaction) isCancelled() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.cancelled
+}
+
+// cancel cancels all pending branches and prevents new ones, after a
+// CANCEL from upstream or a 2xx or 6xx on another branch.
+func (t *proxyTransaction) cancel() {
+	t.mutex.Lock()
+	t.cancelled = true
+	branches := append([]*proxyBranch{}, t.branches...)
+	t.mutex.Unlock()
+	for _, b := range branches {
+		b.cancel()
+	}
+}
+
+// start tells whether the request of b may still be sent on conn.
+func (b *proxyBranch) start(conn *clientConnection) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.conn = conn
+	return !b.cancelled
+}
+
+func (b *proxyBranch) finish() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.done = true
+}
+
+// cancel sends a CANCEL for a pending INVITE. As a CANCEL must not
+// overtake the INVITE, it is deferred until a provisional response
+// arrives (RFC 3261, section 9.1).
+func (b *proxyBranch) cancel() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.cancelled || b.done {
+		return
+	}
+	b.cancelled = true
+	if b.provisional {
+		b.sendCancel()
+	}
+}
+
+func (b *proxyBranch) onProvisional() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.cancelled && !b.provisional {
+		b.sendCancel()
+	}
+	b.provisional = true
+}
+
+func (b *proxyBranch) sendCancel() {
+	if b.conn == nil || b.forwarded.Headline.(RequestHeadline).Method != "INVITE" {
+		return
+	}
+	c := CreateCancel(b.forwarded)
+	b.conn.send(&c)
+}
+
+// bestResponse chooses among the non-2xx final responses of all branches
+// (RFC 3261, section 16.7, steps 6 and 7): 6xx first, then the lowest
+// class. Among 4xx, responses the client may be able to fix are
+// preferred. 503 is returned as 500, as the service is only unavailable
+// downstream. The challenges of all 401 and 407 responses are collected
+// in the one returned, so that the client can answer all of them. It
+// returns nil if there are no responses.
+func bestResponse(responses []*Message) *Message {
+	if len(responses) == 0 {
+		return nil
+	}
+	rank := func(m *Message) int {
+		code := m.Headline.(ResponseHeadline).Code
+		switch code {
+		case 401, 407, 415, 420, 484:
+			return 7
+		}
+		if code >= 600 {
+			return 0
+		}
+		return code / 100 * 2
+	}
+	best := responses[0]
+	for _, m := range responses[1:] {
+		if rank(m) < rank(best) {
+			best = m
+		}
+	}
+	switch best.Headline.(ResponseHeadline).Code {
+	case 503:
+		c := best.Clone()
+		c.Headline = CreateResponseHeadline("SIP/"+sipversion, 500, ReasonPhrase(500))
+		best = &c
+	case 401, 407:
+		c := best.Clone()
+		for _, m := range responses {
+			if m == best || !isChallenge(m) {
+				continue
+			}
+			for _, name := range []string{"WWW-Authenticate", "Proxy-Authenticate"} {
+				for _, line := range m.Headers.FindHeadersByName(name) {
+					c.Headers.AddHeader(line.Name, line.Value)
+				}
+			}
+		}
+		best = &c
+	}
+	return best
+}
@@ -0,0 +1,182 @@
+package sip
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// proxyAnswer returns the response of p to req, received on a pipe.
+func proxyAnswer(t *testing.T, s *SipClient, req *Message) *Message {
+	local, remote := net.Pipe()
+	defer local.Close()
+	d := CreateDialog(remote, s)
+	defer remote.Close()
+	answers := make(chan *Message, 1)
+	p := NewParser(local)
+	p.SetCallback(func(m *Message) { answers <- m })
+	p.StartParsing()
+
+	go s.Proxy.HandleRequest(d, req)
+	select {
+	case m := <-answers:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("No answer from the proxy")
+	}
+	return nil
+}
+
+func proxyRequest(method string, uri string) *Message {
+	info := &RegisterInfo{Registrar: Connectinfo{"tcp", "example.com", 5060}, Client: Connectinfo{"tcp", "192.0.2.1", 5060}, Username: "alice"}
+	req := info.NewRequest(method, uri)
+	return &req
+}
+
+func TestProxyRejects(t *testing.T) {
+	s := CreateClient()
+	s.Proxy = NewProxy(&s, "192.0.2.10", 5060)
+	s.Proxy.Router = func(*Message) ([]Target, error) { return nil, nil }
+
+	req := proxyRequest("MESSAGE", "sip:bob@example.com")
+	req.SetMaxForwards(0)
+	if m := proxyAnswer(t, &s, req); responseCode(m) != 483 {
+		t.Fatal(m.String())
+	}
+
+	// A request coming back unchanged loops, the hash is that of the
+	// request as received, even if it was strictly routed.
+	received := proxyRequest("MESSAGE", "sip:192.0.2.10;lr")
+	received.SetRoutes([]Address{{Uri: ParseSipUri("sip:bob@example.com")}})
+	hash := s.Proxy.loopHash(received)
+	preprocessed := received.Clone()
+	s.Proxy.preprocessRoutes(&preprocessed)
+	forwarded, _ := s.Proxy.prepare(&preprocessed, hash, ParseSipUri("sip:bob@example.com"), 69)
+	looped := received.Clone()
+	looped.Headers.PrependHeader("Via", forwarded.Headers.FindHeadersByName("Via")[0].Value)
+	if m := proxyAnswer(t, &s, &looped); responseCode(m) != 482 {
+		t.Fatal(m.String())
+	}
+
+	// With another Request-URI it is spiralling, and no target is found.
+	forwarded.Headers.RemoveHeader("Route")
+	if m := proxyAnswer(t, &s, &forwarded); responseCode(m) != 404 {
+		t.Fatal(m.String())
+	}
+}
+
+func TestProxyRecordRoute(t *testing.T) {
+	s := CreateClient()
+	p := NewProxy(&s, "192.0.2.10", 5060)
+	p.RecordRoute = true
+
+	req := proxyRequest("INVITE", "sip:bob@example.com")
+	req.Headers.AddHeader("Record-Route", "<sip:p1.example.com;lr>")
+	forwarded, hop := p.prepare(req, p.loopHash(req), ParseSipUri("sip:bob@192.0.2.4"), 69)
+	recordRoutes := forwarded.Headers.FindHeadersByName("Record-Route")
+	if len(recordRoutes) != 2 || recordRoutes[0].Value != "<sip:192.0.2.10:5060;transport=tcp;lr>" {
+		t.Fatal(recordRoutes)
+	}
+	if hop.String() != "sip:bob@192.0.2.4" {
+		t.Fatal(hop.String())
+	}
+	if maxForwards, _ := forwarded.GetMaxForwards(); maxForwards != 69 {
+		t.Fatal(maxForwards)
+	}
+
+	register := proxyRequest("REGISTER", "sip:example.com")
+	if forwarded, _ := p.prepare(register, p.loopHash(register), ParseSipUri("sip:example.com"), 69); len(forwarded.Headers.FindHeadersByName("Record-Route")) != 0 {
+		t.Fatal("Record-Route added to REGISTER")
+	}
+}
+
+func TestProxyPreprocessRoutes(t *testing.T) {
+	s := CreateClient()
+	p := NewProxy(&s, "192.0.2.10", 5060)
+
+	// The previous hop was a strict router: the Request-URI is our
+	// Record-Route entry and the last Route the original Request-URI.
+	req := proxyRequest("BYE", "sip:192.0.2.10;transport=tcp;lr")
+	req.SetRoutes([]Address{{Uri: ParseSipUri("sip:p2.example.com;lr")}, {Uri: ParseSipUri("sip:bob@192.0.2.4")}})
+	p.preprocessRoutes(req)
+	routes, _ := req.Routes()
+	if uri := req.Headline.(RequestHeadline).Uri.String(); uri != "sip:bob@192.0.2.4" {
+		t.Fatal(uri)
+	}
+	if len(routes) != 1 || routes[0].Uri.Host != "p2.example.com" {
+		t.Fatal(routes)
+	}
+
+	// Loose routing: our entry is removed from the top of the route.
+	req = proxyRequest("BYE", "sip:bob@192.0.2.4")
+	req.SetRoutes([]Address{{Uri: ParseSipUri("sip:192.0.2.10:5060;lr")}, {Uri: ParseSipUri("sip:p2.example.com;lr")}})
+	p.preprocessRoutes(req)
+	routes, _ = req.Routes()
+	if uri := req.Headline.(RequestHeadline).Uri.String(); uri != "sip:bob@192.0.2.4" {
+		t.Fatal(uri)
+	}
+	if len(routes) != 1 || routes[0].Uri.Host != "p2.example.com" {
+		t.Fatal(routes)
+	}
+}
+
+func TestProxyStatelessRelay(t *testing.T) {
+	downstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downstream.Close()
+	go func() {
+		for {
+			conn, err := downstream.Accept()
+			if err != nil {
+				return
+			}
+			p := NewParser(conn)
+			p.SetCallback(func(m *Message) {
+				c := CreateResponseTo(m, 200, ReasonPhrase(200))
+				data, _ := c.MarshalBinary()
+				conn.Write(data)
+			})
+			p.StartParsing()
+		}
+	}()
+
+	px := CreateClient()
+	defer px.Shutdown()
+	if err := px.Listen("tcp", "127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	var port int
+	for _, l := range px.Listeners {
+		port = l.listener.Addr().(*net.TCPAddr).Port
+	}
+	px.Proxy = NewProxy(&px, "127.0.0.1", port)
+	px.Proxy.Stateful = false
+
+	// The Via of the client names a port nobody listens on, the response
+	// is relayed on the connection the request came in on.
+	s := CreateClient()
+	defer s.Shutdown()
+	conn, err := s.dial(context.Background(), Connectinfo{"tcp", "127.0.0.1", port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.release()
+	req := proxyRequest("MESSAGE", "sip:bob@127.0.0.1:"+strconv.Itoa(downstream.Addr().(*net.TCPAddr).Port))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	m, err := conn.transact(ctx, req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vias, _ := m.Vias()
+	if responseCode(m) != 200 || len(vias) != 1 || vias[0].Host != "192.0.2.1" {
+		t.Fatal(m.String())
+	}
+	if received, _ := vias[0].Params.Get("received"); received != "127.0.0.1" {
+		t.Fatal(m.String())
+	}
+}
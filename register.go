@@ -1,10 +1,58 @@
 package sip
 
+import (
+	"fmt"
+	"time"
+)
+
 type RegisterInfo struct {
+	// Registrar is located like a request URI (RFC 3263): without Port
+	// and Transport, its NAPTR and SRV records are used.
 	Registrar Connectinfo
 	Client    Connectinfo
 	Username  string
 	UserInfo  UserInfo
 
+	// Expiration is the registration interval in seconds requested from
+	// the registrar. DefaultExpiration is used if it is 0.
 	Expiration int
+
+	// OutboundProxy, if its Host is set, receives all requests of this
+	// account instead of SipClient.OutboundProxy.
+	OutboundProxy Connectinfo
+
+	// InstanceID and RegID enable SIP Outbound (RFC 5626) if both are
+	// set. InstanceID identifies the device, e.g. "urn:uuid:...", and
+	// RegID the flow. The connection of the registration is then kept
+	// open to receive requests, kept alive, and registered again when it
+	// fails.
+	InstanceID string
+	RegID      int
+
+	// KeepaliveInterval, if set, overrides the interval of outbound
+	// keepalives.
+	KeepaliveInterval time.Duration
+}
+
+var DefaultExpiration = 300
+
+func (r *RegisterInfo) RequestedExpiration() int {
+	if r.Expiration <= 0 {
+		return DefaultExpiration
+	}
+	return r.Expiration
+}
+
+// AccountID identifies the account registered by r, unless set
+// explicitly by RegisterAccount.
+func (r *RegisterInfo) AccountID() string {
+	registrar := r.Registrar
+	return fmt.Sprintf("%s@%s;transport=%s", r.Username, joinHostPort(registrar.Host, registrar.Port), registrar.Transport)
+}
+
+// isOwnContact tells whether contact is the binding created by r.
+func (r *RegisterInfo) isOwnContact(contact Address) bool {
+	return contact.Uri.User == r.Username &&
+		sameHost(contact.Uri.Host, r.Client.Host) &&
+		(contact.Uri.Port == r.Client.Port || contact.Uri.Port == 0 && r.Client.Port == 5060)
 }
@@ -0,0 +1,220 @@
+package sip
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Registrar answers REGISTER requests and keeps the bindings in a
+// LocationStore (RFC 3261, section 10.3). If Authenticator is set,
+// requests are challenged and users may only register their own
+// address-of-record.
+type Registrar struct {
+	Store         LocationStore
+	Authenticator *Authenticator
+
+	// Domains, if set, are the domains the registrar is responsible for.
+	// Requests with another domain in the Request-URI are rejected with
+	// 404 (RFC 3261, section 10.3).
+	Domains []string
+
+	// MinExpires and MaxExpires bound the registration interval,
+	// DefaultExpires is used if the request gives none. All are in
+	// seconds.
+	MinExpires     int
+	MaxExpires     int
+	DefaultExpires int
+
+	mutex sync.Mutex
+}
+
+func NewRegistrar(store LocationStore) *Registrar {
+	return &Registrar{
+		Store:          store,
+		MinExpires:     60,
+		MaxExpires:     7200,
+		DefaultExpires: 3600,
+	}
+}
+
+// HandleRegister processes a REGISTER request and returns the response
+// to send.
+func (r *Registrar) HandleRegister(req *Message) *Message {
+	reply := func(code int) *Message {
+		c := CreateResponseTo(req, code, ReasonPhrase(code))
+		return &c
+	}
+
+	if !r.isLocalDomain(req.Headline.(RequestHeadline).Uri.Host) {
+		return reply(404)
+	}
+	to, err := req.ToAddress()
+	if err != nil {
+		return reply(400)
+	}
+	if r.Authenticator != nil {
+		username, challenge := r.Authenticator.Authenticate(req)
+		if challenge != nil {
+			return challenge
+		}
+		if username != to.Uri.User {
+			log.Println("User ", username, " may not register ", to.Uri.String())
+			return reply(403)
+		}
+	}
+	contacts, err := req.Contacts()
+	if err != nil {
+		return reply(400)
+	}
+	aor := addressOfRecord(to.Uri)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	bindings, err := r.Store.Lookup(aor)
+	if err != nil {
+		log.Println("Error looking up bindings of ", aor, ": ", err)
+		return reply(500)
+	}
+	if len(contacts) > 0 {
+		var code int
+		bindings, code = r.update(req, bindings, contacts)
+		if code == 423 {
+			c := reply(423)
+			c.AddHeader("Min-Expires", strconv.Itoa(r.MinExpires))
+			return c
+		}
+		if code != 0 {
+			return reply(code)
+		}
+		if err := r.Store.Store(aor, bindings); err != nil {
+			log.Println("Error storing bindings of ", aor, ": ", err)
+			return reply(500)
+		}
+		bindings, _ = r.Store.Lookup(aor)
+	}
+
+	c := reply(200)
+	for _, binding := range bindings {
+		contact := binding.Contact
+		contact.Params = append(Params{}, contact.Params...)
+		contact.Params.Set("expires", strconv.Itoa(binding.ExpiresIn()))
+		c.AddHeader("Contact", contact.String())
+	}
+	c.AddHeader("Date", time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
+	return c
+}
+
+func (r *Registrar) isLocalDomain(host string) bool {
+	if len(r.Domains) == 0 {
+		return true
+	}
+	for _, domain := range r.Domains {
+		if sameHost(domain, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies the contacts of req to bindings. It returns the status
+// code to reject req with, 0 on success.
+func (r *Registrar) update(req *Message, bindings []Binding, contacts []Address) ([]Binding, int) {
+	callID := req.GetCallId()
+	cseq, _ := req.GetCSeq()
+	headerExpires, err := req.GetExpires()
+	if err != nil {
+		headerExpires = r.DefaultExpires
+	}
+
+	// Requests are ordered per Call-ID: an older request must not
+	// overwrite what a newer one registered.
+	outOfOrder := func(binding Binding) bool {
+		return binding.CallID == callID && binding.CSeq >= cseq
+	}
+
+	for _, contact := range contacts {
+		if !contact.Wildcard {
+			continue
+		}
+		if len(contacts) != 1 || headerExpires != 0 {
+			return nil, 400
+		}
+		for _, binding := range bindings {
+			if outOfOrder(binding) {
+				return nil, 500
+			}
+		}
+		return nil, 0
+	}
+
+	now := time.Now()
+	for _, contact := range contacts {
+		expires := headerExpires
+		if value, ok := contact.Params.Get("expires"); ok {
+			expires, err = strconv.Atoi(value)
+			if err != nil || expires < 0 {
+				return nil, 400
+			}
+		}
+		if expires > 0 && expires < r.MinExpires {
+			return nil, 423
+		}
+		if expires > r.MaxExpires {
+			expires = r.MaxExpires
+		}
+		q := 1.0
+		if value, ok := contact.Params.Get("q"); ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil || q < 0 || q > 1 {
+				return nil, 400
+			}
+		}
+
+		contact.Params = append(Params{}, contact.Params...)
+		contact.Params.Del("expires")
+		binding := Binding{
+			Contact: contact,
+			Expires: now.Add(time.Duration(expires) * time.Second),
+			Q:       q,
+			CallID:  callID,
+			CSeq:    cseq,
+		}
+
+		found := false
+		for i := range bindings {
+			if !sameBinding(bindings[i].Contact, contact) {
+				continue
+			}
+			found = true
+			if outOfOrder(bindings[i]) {
+				return nil, 500
+			}
+			if expires == 0 {
+				bindings = append(bindings[:i], bindings[i+1:]...)
+			} else {
+				bindings[i] = binding
+			}
+			break
+		}
+		if !found && expires > 0 {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings, 0
+}
+
+// sameBinding tells whether contact updates the binding of existing:
+// with the same instance and reg-id for SIP Outbound (RFC 5626, section
+// 6), with the same URI otherwise.
+func sameBinding(existing Address, contact Address) bool {
+	instance, hasInstance := contact.Params.Get("+sip.instance")
+	regID, hasRegID := contact.Params.Get("reg-id")
+	if hasInstance && hasRegID {
+		existingInstance, _ := existing.Params.Get("+sip.instance")
+		existingRegID, _ := existing.Params.Get("reg-id")
+		return existingInstance == instance && existingRegID == regID
+	}
+	return existing.Uri.String() == contact.Uri.String()
+}
@@ -0,0 +1,149 @@
+package sip
+
+import (
+	"strconv"
+	"testing"
+)
+
+// registerRequest returns a REGISTER of bob with the given Contact
+// header values and Expires header, none if expires is negative.
+func registerRequest(uri string, cseq uint32, expires int, contacts ...string) *Message {
+	req := CreateRequest("REGISTER", uri)
+	req.SetVia("TCP", "192.0.2.1", 5060, "z9hG4bK"+strconv.Itoa(int(cseq)))
+	req.SetFrom("sip", "bob", "example.com", "a1")
+	req.SetTo("sip", "bob", "example.com", "")
+	req.SetCallId("registrar-test")
+	req.SetCSeq(cseq, "REGISTER")
+	for _, contact := range contacts {
+		req.AddHeader("Contact", contact)
+	}
+	if expires >= 0 {
+		req.SetExpires(expires)
+	}
+	req.SetContentLength(0)
+	return &req
+}
+
+func responseCode(m *Message) int {
+	return m.Headline.(ResponseHeadline).Code
+}
+
+// contactExpires returns the expires parameter of every Contact of m by
+// URI.
+func contactExpires(t *testing.T, m *Message) map[string]string {
+	contacts, err := m.Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := make(map[string]string)
+	for _, contact := range contacts {
+		expires[contact.Uri.String()], _ = contact.Params.Get("expires")
+	}
+	return expires
+}
+
+func TestRegistrarBindings(t *testing.T) {
+	store := NewMemoryLocationStore()
+	r := NewRegistrar(store)
+
+	m := r.HandleRegister(registerRequest("sip:example.com", 1, 300,
+		"<sip:bob@192.0.2.1>;q=0.5",
+		"<sip:bob@192.0.2.2>;expires=120",
+		"<sip:bob@192.0.2.3>;expires=100000"))
+	if responseCode(m) != 200 {
+		t.Fatal(m.String())
+	}
+	expires := contactExpires(t, m)
+	if len(expires) != 3 || expires["sip:bob@192.0.2.1"] != "300" || expires["sip:bob@192.0.2.2"] != "120" || expires["sip:bob@192.0.2.3"] != "7200" {
+		t.Fatal("Contacts: ", expires)
+	}
+	bindings, _ := store.Lookup("sip:bob@example.com")
+	if len(bindings) != 3 || bindings[len(bindings)-1].Q != 0.5 {
+		t.Fatal(bindings)
+	}
+
+	// A query lists all bindings, and removing one keeps the others.
+	if m := r.HandleRegister(registerRequest("sip:example.com", 2, -1)); len(contactExpires(t, m)) != 3 {
+		t.Fatal(m.String())
+	}
+	m = r.HandleRegister(registerRequest("sip:example.com", 3, 0, "<sip:bob@192.0.2.2>"))
+	if expires := contactExpires(t, m); responseCode(m) != 200 || len(expires) != 2 || expires["sip:bob@192.0.2.2"] != "" {
+		t.Fatal(m.String())
+	}
+}
+
+func TestRegistrarRejects(t *testing.T) {
+	r := NewRegistrar(NewMemoryLocationStore())
+	r.Domains = []string{"example.com"}
+	tests := []struct {
+		name     string
+		req      *Message
+		expected int
+	}{
+		{"other domain", registerRequest("sip:example.org", 1, 300, "<sip:bob@192.0.2.1>"), 404},
+		{"q above 1", registerRequest("sip:example.com", 1, 300, "<sip:bob@192.0.2.1>;q=1.5"), 400},
+		{"q not a number", registerRequest("sip:example.com", 1, 300, "<sip:bob@192.0.2.1>;q=high"), 400},
+		{"negative expires", registerRequest("sip:example.com", 1, 300, "<sip:bob@192.0.2.1>;expires=-1"), 400},
+		{"wildcard with contacts", registerRequest("sip:example.com", 1, 0, "*", "<sip:bob@192.0.2.1>"), 400},
+		{"wildcard with expiry", registerRequest("sip:example.com", 1, 300, "*"), 400},
+		{"wildcard without Expires", registerRequest("sip:example.com", 1, -1, "*"), 400},
+	}
+	for _, test := range tests {
+		if m := r.HandleRegister(test.req); responseCode(m) != test.expected {
+			t.Errorf("%s: got %d, expected %d", test.name, responseCode(m), test.expected)
+		}
+	}
+
+	m := r.HandleRegister(registerRequest("sip:example.com", 1, 10, "<sip:bob@192.0.2.1>"))
+	if minExpires, err := m.GetMinExpires(); responseCode(m) != 423 || err != nil || minExpires != 60 {
+		t.Fatal(m.String())
+	}
+}
+
+func TestRegistrarOrdering(t *testing.T) {
+	store := NewMemoryLocationStore()
+	r := NewRegistrar(store)
+	if m := r.HandleRegister(registerRequest("sip:example.com", 5, 300, "<sip:bob@192.0.2.1>")); responseCode(m) != 200 {
+		t.Fatal(m.String())
+	}
+	// Older or repeated requests of the same Call-ID are rejected.
+	for _, cseq := range []uint32{4, 5} {
+		if m := r.HandleRegister(registerRequest("sip:example.com", cseq, 0, "<sip:bob@192.0.2.1>")); responseCode(m) != 500 {
+			t.Error("CSeq ", cseq, ": ", m.String())
+		}
+		if m := r.HandleRegister(registerRequest("sip:example.com", cseq, 0, "*")); responseCode(m) != 500 {
+			t.Error("CSeq ", cseq, " with wildcard: ", m.String())
+		}
+	}
+	if bindings, _ := store.Lookup("sip:bob@example.com"); len(bindings) != 1 {
+		t.Fatal(bindings)
+	}
+
+	if m := r.HandleRegister(registerRequest("sip:example.com", 6, 0, "*")); responseCode(m) != 200 || len(contactExpires(t, m)) != 0 {
+		t.Fatal(m.String())
+	}
+	if bindings, _ := store.Lookup("sip:bob@example.com"); len(bindings) != 0 {
+		t.Fatal(bindings)
+	}
+}
+
+func TestRegistrarOutboundBindings(t *testing.T) {
+	store := NewMemoryLocationStore()
+	r := NewRegistrar(store)
+	instance := `+sip.instance="<urn:uuid:00000000-0000-1000-8000-000a95a0e128>"`
+
+	r.HandleRegister(registerRequest("sip:example.com", 1, 300, "<sip:bob@192.0.2.1>;"+instance+";reg-id=1"))
+	// The same instance and reg-id replace the binding, even from another
+	// address.
+	r.HandleRegister(registerRequest("sip:example.com", 2, 300, "<sip:bob@192.0.2.9>;"+instance+";reg-id=1"))
+	bindings, _ := store.Lookup("sip:bob@example.com")
+	if len(bindings) != 1 || bindings[0].Contact.Uri.Host != "192.0.2.9" {
+		t.Fatal(bindings)
+	}
+	// Another reg-id is another flow of the same instance.
+	m := r.HandleRegister(registerRequest("sip:example.com", 3, 300, "<sip:bob@192.0.2.9>;"+instance+";reg-id=2"))
+	bindings, _ = store.Lookup("sip:bob@example.com")
+	if responseCode(m) != 200 || len(bindings) != 2 {
+		t.Fatal(bindings)
+	}
+}
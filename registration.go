@@ -0,0 +1,434 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TransactionTimeout bounds how long a request waits for its final
+// response if the context passed in has no earlier deadline (Timer F).
+var TransactionTimeout = 32 * time.Second
+
+type RegistrationState int
+
+const (
+	UNREGISTERED RegistrationState = iota
+	REGISTERING
+	REGISTERED
+	UNREGISTERING
+	RETRY_WAIT
+	FAILED
+)
+
+func (r RegistrationState) String() string {
+	switch r {
+	case UNREGISTERED:
+		return "UNREGISTERED"
+	case REGISTERING:
+		return "REGISTERING"
+	case REGISTERED:
+		return "REGISTERED"
+	case UNREGISTERING:
+		return "UNREGISTERING"
+	case RETRY_WAIT:
+		return "RETRY_WAIT"
+	case FAILED:
+		return "FAILED"
+	}
+	return "UNKNOWN"
+}
+
+// RegistrationEvent reports a state change. For RETRY_WAIT, RetryIn tells
+// when the next attempt is made and Err why the last one failed.
+type RegistrationEvent struct {
+	State   RegistrationState
+	Expires int
+	Err     error
+	RetryIn time.Duration
+}
+
+// RegistrationError is returned if the registrar rejected a REGISTER.
+type RegistrationError struct {
+	Code       int
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func newRegistrationError(m *Message) *RegistrationError {
+	responseHeader := m.Headline.(ResponseHeadline)
+	e := &RegistrationError{Code: responseHeader.Code, Reason: responseHeader.Reply}
+	if retryAfter, err := m.GetRetryAfter(); err == nil {
+		e.RetryAfter = time.Duration(retryAfter) * time.Second
+	}
+	return e
+}
+
+func (e *RegistrationError) Error() string {
+	return fmt.Sprintf("Registration rejected: %d %s", e.Code, e.Reason)
+}
+
+// RetryPolicy controls how a registration is retried after a failed
+// refresh, following the flow recovery algorithm of RFC 5626, section 4.5:
+//
+//	wait-time = min(MaxTime, BaseTime * 2^consecutive-failures)
+//
+// and the actual delay is a random value between 50% and 100% of
+// wait-time. A Retry-After received from the registrar takes precedence
+// if it is longer. MaxAttempts limits the number of consecutive failed
+// attempts, 0 retries forever.
+type RetryPolicy struct {
+	BaseTime    time.Duration
+	MaxTime     time.Duration
+	MaxAttempts int
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	BaseTime: 30 * time.Second,
+	MaxTime:  1800 * time.Second,
+}
+
+func (p RetryPolicy) Delay(consecutiveFailures int) time.Duration {
+	// Doubling stops at MaxTime, so that wait cannot overflow.
+	wait := p.BaseTime
+	for i := 0; i < consecutiveFailures && wait > 0 && wait < p.MaxTime; i++ {
+		if wait > p.MaxTime/2 {
+			wait = p.MaxTime
+		} else {
+			wait *= 2
+		}
+	}
+	if wait > p.MaxTime {
+		wait = p.MaxTime
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// Registration is a handle on a registration kept alive by SipClient.
+// Changes delivers every state change; events are dropped if the channel
+// is not drained. The channel is closed once the registration ended.
+type Registration struct {
+	client *SipClient
+	id     string
+	info   *RegisterInfo
+	callID string
+	cseq   uint32
+	from   string
+
+	requested int
+
+	mutex   sync.Mutex
+	state   RegistrationState
+	expires int
+	changes chan RegistrationEvent
+	ended   bool
+	endOnce sync.Once
+	cancel  context.CancelFunc
+	done    chan bool
+
+	// flow is the connection kept open by an outbound registration.
+	// flowFailed is signalled when it fails.
+	flow       *clientConnection
+	flowFailed chan error
+}
+
+func newRegistration(client *SipClient, id string, info *RegisterInfo) *Registration {
+	r := &Registration{
+		client:     client,
+		id:         id,
+		info:       info,
+		callID:     RandSeq(10),
+		cseq:       100,
+		state:      UNREGISTERED,
+		changes:    make(chan RegistrationEvent, 16),
+		done:       make(chan bool),
+		flowFailed: make(chan error, 1),
+	}
+	r.requested = info.RequestedExpiration()
+	return r
+}
+
+func (r *Registration) AccountID() string {
+	return r.id
+}
+
+func (r *Registration) State() RegistrationState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.state
+}
+
+// Expires returns the expiry in seconds granted by the registrar.
+func (r *Registration) Expires() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.expires
+}
+
+func (r *Registration) Changes() <-chan RegistrationEvent {
+	return r.changes
+}
+
+func (r *Registration) setState(state RegistrationState, expires int, err error) {
+	r.emit(RegistrationEvent{State: state, Expires: expires, Err: err})
+}
+
+func (r *Registration) emit(event RegistrationEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.state = event.State
+	r.expires = event.Expires
+	if r.ended {
+		return
+	}
+	select {
+	case r.changes <- event:
+	default:
+		log.Println("Registration event dropped: ", event.State)
+	}
+}
+
+// end closes Changes. Later state changes are not delivered anymore.
+func (r *Registration) end() {
+	r.endOnce.Do(func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.ended = true
+		close(r.changes)
+	})
+}
+
+// remove drops r from the registrations of its client, unless it was
+// replaced.
+func (r *Registration) remove() {
+	r.client.mutex.Lock()
+	defer r.client.mutex.Unlock()
+	if r.client.registrations[r.id] == r {
+		delete(r.client.registrations, r.id)
+	}
+}
+
+func (r *Registration) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	go r.run(ctx)
+}
+
+// run refreshes the registration until ctx is done, retrying failed
+// attempts according to the client's RetryPolicy.
+func (r *Registration) run(ctx context.Context) {
+	defer close(r.done)
+	failures := 0
+	wait := refreshInterval(r.Expires())
+	for {
+		select {
+		case <-time.After(wait):
+		case err := <-r.flowFailed:
+			// RFC 5626, section 4.5: register again right away on a new
+			// flow.
+			r.setState(REGISTERING, 0, err)
+		case <-ctx.Done():
+			return
+		}
+		if failures > 0 {
+			r.setState(REGISTERING, 0, nil)
+		}
+		result, expires, err := r.client.register(ctx, r, false)
+		if ctx.Err() != nil {
+			return
+		}
+		if result == OKAY {
+			failures = 0
+			r.setState(REGISTERED, expires, nil)
+			wait = refreshInterval(expires)
+			continue
+		}
+
+		failures++
+		policy := r.client.RetryPolicy
+		if policy.MaxAttempts > 0 && failures >= policy.MaxAttempts {
+			r.setState(FAILED, 0, err)
+			r.remove()
+			r.closeFlow()
+			r.end()
+			return
+		}
+		wait = policy.Delay(failures)
+		if registrationErr, ok := err.(*RegistrationError); ok && registrationErr.RetryAfter > wait {
+			wait = registrationErr.RetryAfter
+		}
+		log.Println("Registration failed, retrying in ", wait, ": ", err)
+		r.emit(RegistrationEvent{State: RETRY_WAIT, Err: err, RetryIn: wait})
+	}
+}
+
+// grantedExpires reads the expiry of our binding from a 200 response to
+// REGISTER: the expires parameter of our Contact, the Expires header or
+// else the requested interval.
+func (r *Registration) grantedExpires(m *Message) int {
+	contacts, err := m.Contacts()
+	if err == nil {
+		for _, contact := range contacts {
+			value, found := contact.Params.Get("expires")
+			if !found || !r.info.isOwnContact(contact) {
+				continue
+			}
+			if expires, err := strconv.Atoi(value); err == nil {
+				return expires
+			}
+		}
+	}
+	if expires, err := m.GetExpires(); err == nil {
+		return expires
+	}
+	return r.requested
+}
+
+// refreshInterval returns when to refresh a binding granted for expires
+// seconds: after 80% of the interval, but at least one second later.
+func refreshInterval(expires int) time.Duration {
+	interval := time.Duration(expires) * time.Second * 8 / 10
+	if interval < time.Second {
+		return time.Second
+	}
+	return interval
+}
+
+// stop ends the refresh loop without unregistering, closes the flow of
+// an outbound registration and closes Changes.
+func (r *Registration) stop() {
+	r.stopRefresh()
+	r.closeFlow()
+	r.end()
+}
+
+func (r *Registration) stopRefresh() {
+	if r.cancel != nil {
+		r.cancel()
+		<-r.done
+	}
+}
+
+// Unregister stops refreshing and removes the binding at the registrar.
+// It can be called again, e.g. after the registration failed.
+func (r *Registration) Unregister(ctx context.Context) error {
+	_, err := r.unregister(ctx)
+	return err
+}
+
+func (r *Registration) unregister(ctx context.Context) (RegistrationResult, error) {
+	r.remove()
+	r.stopRefresh()
+	r.setState(UNREGISTERING, r.Expires(), nil)
+	result, _, err := r.client.register(ctx, r, true)
+	if result == OKAY {
+		r.setState(UNREGISTERED, 0, nil)
+	} else {
+		r.setState(FAILED, 0, err)
+	}
+	r.end()
+	return result, err
+}
+
+// Register registers at registerInfo.Registrar and keeps refreshing the
+// registration until it is unregistered. ctx bounds the initial
+// registration only. The account is keyed by registerInfo.AccountID().
+// If the initial registration fails, the error is returned and nothing
+// is retried, as there is no registration to hand out yet; RetryPolicy
+// applies to the refreshes of a registration once it succeeded.
+func (s *SipClient) Register(ctx context.Context, registerInfo *RegisterInfo) (*Registration, error) {
+	return s.RegisterAccount(ctx, registerInfo.AccountID(), registerInfo)
+}
+
+// RegisterAccount is like Register with an explicit account ID. A
+// registration already running for accountID is replaced, without
+// unregistering it.
+func (s *SipClient) RegisterAccount(ctx context.Context, accountID string, registerInfo *RegisterInfo) (*Registration, error) {
+	r, _, err := s.startRegistration(ctx, accountID, registerInfo)
+	return r, err
+}
+
+func (s *SipClient) startRegistration(ctx context.Context, accountID string, registerInfo *RegisterInfo) (*Registration, RegistrationResult, error) {
+	r := newRegistration(s, accountID, registerInfo)
+	r.setState(REGISTERING, 0, nil)
+	result, expires, err := s.register(ctx, r, false)
+	if result != OKAY {
+		r.setState(FAILED, 0, err)
+		r.end()
+		return nil, result, err
+	}
+	r.setState(REGISTERED, expires, nil)
+	r.start()
+
+	s.mutex.Lock()
+	previous := s.registrations[accountID]
+	s.registrations[accountID] = r
+	s.mutex.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+	return r, OKAY, nil
+}
+
+func (s *SipClient) removeRegistration(accountID string) (*Registration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r, found := s.registrations[accountID]
+	delete(s.registrations, accountID)
+	return r, found
+}
+
+func (s *SipClient) Registration(accountID string) (*Registration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r, found := s.registrations[accountID]
+	return r, found
+}
+
+// Accounts returns the IDs of all running registrations.
+func (s *SipClient) Accounts() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var ids []string
+	for id := range s.registrations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *SipClient) DeregisterAccount(ctx context.Context, accountID string) error {
+	r, found := s.removeRegistration(accountID)
+	if !found {
+		return errors.New("No registration for account " + accountID)
+	}
+	return r.Unregister(ctx)
+}
+
+// DeregisterAll unregisters all accounts concurrently.
+func (s *SipClient) DeregisterAll(ctx context.Context) error {
+	var wg sync.WaitGroup
+	ids := s.Accounts()
+	errs := make(chan error, len(ids))
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := s.DeregisterAccount(ctx, id); err != nil {
+				errs <- err
+			}
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
@@ -0,0 +1,316 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		policy   RetryPolicy
+		failures int
+		max      time.Duration
+	}{
+		{DefaultRetryPolicy, 0, 30 * time.Second},
+		{DefaultRetryPolicy, 1, 60 * time.Second},
+		{DefaultRetryPolicy, 5, 960 * time.Second},
+		{DefaultRetryPolicy, 6, 1800 * time.Second},
+		{DefaultRetryPolicy, 29, 1800 * time.Second},
+		{DefaultRetryPolicy, 30, 1800 * time.Second},
+		{DefaultRetryPolicy, 64, 1800 * time.Second},
+		{DefaultRetryPolicy, math.MaxInt32, 1800 * time.Second},
+		{RetryPolicy{BaseTime: time.Second, MaxTime: math.MaxInt64}, 100, math.MaxInt64},
+		{RetryPolicy{BaseTime: time.Second, MaxTime: 10 * time.Second}, 3, 8 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			delay := test.policy.Delay(test.failures)
+			if delay < test.max/2 || delay > test.max {
+				t.Fatalf("Delay(%d) with %+v = %s, want between %s and %s", test.failures, test.policy, delay, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyDelayZero(t *testing.T) {
+	if delay := (RetryPolicy{}).Delay(3); delay != 0 {
+		t.Fatal(delay)
+	}
+}
+
+// events returns the events of r until Changes is closed.
+func events(t *testing.T, r *Registration) []RegistrationState {
+	var states []RegistrationState
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-r.Changes():
+			if !ok {
+				return states
+			}
+			states = append(states, event.State)
+		case <-timeout:
+			t.Fatal("Changes not closed after ", states)
+		}
+	}
+}
+
+func TestRegistrationEnds(t *testing.T) {
+	defer func(timeout time.Duration) { TransactionTimeout = timeout }(TransactionTimeout)
+	TransactionTimeout = 200 * time.Millisecond
+
+	registrar := startUDPServer(t, false)
+	s := CreateClient()
+	defer s.Shutdown()
+	s.RetryPolicy = RetryPolicy{BaseTime: time.Second, MaxTime: time.Second, MaxAttempts: 1}
+	info := &RegisterInfo{
+		Registrar: Connectinfo{"udp", "127.0.0.1", registrar.port},
+		Client:    Connectinfo{"udp", "127.0.0.1", 5060},
+		Username:  "alice",
+		UserInfo:  UnauthorizedUserInfo("alice"),
+	}
+
+	// Unregistering twice.
+	r, err := s.RegisterAccount(context.Background(), "alice", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeregisterAccount(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Unregister(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if states := events(t, r); states[len(states)-1] != UNREGISTERED {
+		t.Fatal(states)
+	}
+
+	// Replacing a registration.
+	r, err = s.RegisterAccount(context.Background(), "alice", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := s.RegisterAccount(context.Background(), "alice", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events(t, r)
+
+	// Failing to refresh.
+	registrar.setSilent(true)
+	if states := events(t, replacement); states[len(states)-1] != FAILED {
+		t.Fatal(states)
+	}
+	if len(s.Accounts()) != 0 {
+		t.Fatal("Failed registration still running: ", s.Accounts())
+	}
+	if err := replacement.Unregister(context.Background()); err == nil {
+		t.Fatal("Unregistered without response")
+	}
+}
+
+// startRegistrarPeer answers REGISTER requests over UDP with the
+// responses built by answer, and returns its port.
+func startRegistrarPeer(t *testing.T, answer func(req *Message) *Message) int {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, err := ParseMessage(append([]byte{}, buf[:n]...))
+			if err != nil || m.GetType() != REQUEST {
+				continue
+			}
+			response := answer(m)
+			response.SetContentLength(0)
+			b, _ := response.MarshalBinary()
+			conn.WriteTo(b, addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// nextEvent returns the next event of r which is not REGISTERING.
+func nextEvent(t *testing.T, r *Registration) RegistrationEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-r.Changes():
+			if !ok {
+				t.Fatal("Changes closed")
+			}
+			if event.State != REGISTERING {
+				return event
+			}
+		case <-timeout:
+			t.Fatal("No registration event")
+		}
+	}
+}
+
+func TestRegistrationRetry(t *testing.T) {
+	registers := 0
+	port := startRegistrarPeer(t, func(req *Message) *Message {
+		registers++
+		if registers == 1 {
+			c := CreateResponseTo(req, 200, "OK")
+			c.SetExpires(1)
+			return &c
+		}
+		c := CreateResponseTo(req, 503, ReasonPhrase(503))
+		c.AddHeader("Retry-After", "120")
+		return &c
+	})
+	s := CreateClient()
+	defer s.Shutdown()
+	s.RetryPolicy = RetryPolicy{BaseTime: 10 * time.Millisecond, MaxTime: time.Second}
+	info := &RegisterInfo{
+		Registrar: Connectinfo{"udp", "127.0.0.1", port},
+		Client:    Connectinfo{"udp", "127.0.0.1", 5060},
+		Username:  "alice",
+		UserInfo:  UnauthorizedUserInfo("alice"),
+	}
+	r, err := s.Register(context.Background(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, r); event.State != REGISTERED {
+		t.Fatal(event.State)
+	}
+	// Retry-After is longer than the backoff of the policy.
+	event := nextEvent(t, r)
+	if event.State != RETRY_WAIT || event.RetryIn != 120*time.Second {
+		t.Fatal(event.State, event.RetryIn)
+	}
+	if registrationErr, ok := event.Err.(*RegistrationError); !ok || registrationErr.Code != 503 {
+		t.Fatal(event.Err)
+	}
+}
+
+func TestRegistrationMaxAttempts(t *testing.T) {
+	registers := 0
+	port := startRegistrarPeer(t, func(req *Message) *Message {
+		registers++
+		code := 500
+		if registers == 1 {
+			code = 200
+		}
+		c := CreateResponseTo(req, code, ReasonPhrase(code))
+		c.SetExpires(1)
+		return &c
+	})
+	s := CreateClient()
+	defer s.Shutdown()
+	s.RetryPolicy = RetryPolicy{BaseTime: 10 * time.Millisecond, MaxTime: 10 * time.Millisecond, MaxAttempts: 2}
+	info := &RegisterInfo{
+		Registrar: Connectinfo{"udp", "127.0.0.1", port},
+		Client:    Connectinfo{"udp", "127.0.0.1", 5060},
+		Username:  "alice",
+		UserInfo:  UnauthorizedUserInfo("alice"),
+	}
+	r, err := s.Register(context.Background(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := events(t, r)
+	expected := []RegistrationState{REGISTERING, REGISTERED, RETRY_WAIT, REGISTERING, FAILED}
+	if fmt.Sprint(states) != fmt.Sprint(expected) {
+		t.Fatal(states)
+	}
+	if len(s.Accounts()) != 0 {
+		t.Fatal("Failed registration still running")
+	}
+}
+
+func TestRegistrationExpires(t *testing.T) {
+	var requested []int
+	port := startRegistrarPeer(t, func(req *Message) *Message {
+		expires, _ := req.GetExpires()
+		requested = append(requested, expires)
+		if expires < 600 {
+			c := CreateResponseTo(req, 423, ReasonPhrase(423))
+			c.AddHeader("Min-Expires", "600")
+			return &c
+		}
+		// The expires parameter of our Contact takes precedence over the
+		// Expires header.
+		c := CreateResponseTo(req, 200, "OK")
+		contact, _ := req.Headers.FindHeaderByName("Contact")
+		c.AddHeader("Contact", "<sip:bob@192.0.2.9>;expires=3600")
+		c.AddHeader("Contact", contact.Value+";expires=900")
+		c.SetExpires(expires)
+		return &c
+	})
+	s := CreateClient()
+	defer s.Shutdown()
+	info := &RegisterInfo{
+		Registrar:  Connectinfo{"udp", "127.0.0.1", port},
+		Client:     Connectinfo{"udp", "127.0.0.1", 5060},
+		Username:   "alice",
+		UserInfo:   UnauthorizedUserInfo("alice"),
+		Expiration: 60,
+	}
+	r, err := s.Register(context.Background(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(requested) != "[60 600]" {
+		t.Fatal("Requested ", requested)
+	}
+	if r.Expires() != 900 {
+		t.Fatal("Granted ", r.Expires())
+	}
+}
+
+func TestRegistrationRemovedBinding(t *testing.T) {
+	registers := 0
+	port := startRegistrarPeer(t, func(req *Message) *Message {
+		registers++
+		c := CreateResponseTo(req, 200, "OK")
+		if registers == 1 {
+			c.SetExpires(1)
+		} else {
+			c.SetExpires(0)
+		}
+		return &c
+	})
+	s := CreateClient()
+	defer s.Shutdown()
+	s.RetryPolicy = RetryPolicy{BaseTime: time.Minute, MaxTime: time.Minute}
+	info := &RegisterInfo{
+		Registrar: Connectinfo{"udp", "127.0.0.1", port},
+		Client:    Connectinfo{"udp", "127.0.0.1", 5060},
+		Username:  "alice",
+		UserInfo:  UnauthorizedUserInfo("alice"),
+	}
+	r, err := s.Register(context.Background(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, r); event.State != REGISTERED {
+		t.Fatal(event.State)
+	}
+	// A refresh granted no expiry: retried with backoff, not refreshed
+	// right away.
+	if event := nextEvent(t, r); event.State != RETRY_WAIT || event.RetryIn < 30*time.Second {
+		t.Fatal(event.State, event.RetryIn)
+	}
+
+	other := *info
+	other.Username = "bob"
+	if _, err := s.Register(context.Background(), &other); err == nil {
+		t.Fatal("Registered without expiry")
+	}
+}
@@ -0,0 +1,316 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+)
+
+// NAPTR is a naming authority pointer record (RFC 3403), used to select
+// the transport for a domain (RFC 3263, section 4.1).
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// Resolver looks up the DNS records needed to locate SIP servers. Names
+// are fully qualified. A name without records may give an empty result or
+// an error.
+type Resolver interface {
+	LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error)
+	LookupSRV(ctx context.Context, name string) ([]*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSResolver is a Resolver which queries the name server at Server, e.g.
+// "192.0.2.1:53", or the name servers of the system if Server is empty.
+type DNSResolver struct {
+	Server string
+}
+
+// DefaultResolver is used by clients without a Resolver of their own.
+var DefaultResolver Resolver = &DNSResolver{}
+
+func (r *DNSResolver) resolver() *net.Resolver {
+	if r.Server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, r.Server)
+		},
+	}
+}
+
+func (r *DNSResolver) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error) {
+	server := r.Server
+	if server == "" {
+		server = systemNameServer()
+	}
+	return queryNAPTR(ctx, server, name)
+}
+
+func (r *DNSResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, records, err := r.resolver().LookupSRV(ctx, "", "", name)
+	return records, err
+}
+
+func (r *DNSResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r.resolver().LookupIPAddr(ctx, host)
+}
+
+// locateTransports are the transports the client can use, in order of
+// preference when the DNS leaves the choice to the client.
+var locateTransports = []string{"tcp", "udp"}
+
+var naptrServices = map[string]string{
+	"SIP+D2T":  "tcp",
+	"SIP+D2U":  "udp",
+	"SIPS+D2T": "tls",
+}
+
+var srvPrefixes = map[string]string{
+	"tcp": "_sip._tcp.",
+	"udp": "_sip._udp.",
+	"tls": "_sips._tcp.",
+}
+
+func isLocateTransport(transport string) bool {
+	for _, t := range locateTransports {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultPort(transport string) int {
+	if transport == "tls" {
+		return 5061
+	}
+	return 5060
+}
+
+func (s *SipClient) resolver() Resolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+	return DefaultResolver
+}
+
+func (s *SipClient) defaultTransport() string {
+	if s.DefaultTransport != "" {
+		return strings.ToLower(s.DefaultTransport)
+	}
+	return "tcp"
+}
+
+// Locate returns the servers to try, in order, for a request to uri
+// (RFC 3263, section 4). The transport comes from the transport
+// parameter, NAPTR records or SRV records of the domain, in that order,
+// and DefaultTransport otherwise. SRV records are ordered by priority and
+// weight, and every address of a server is a separate entry to fail over
+// to. sips URIs are rejected, as there is no TLS transport.
+func (s *SipClient) Locate(ctx context.Context, uri SipUri) ([]Connectinfo, error) {
+	if strings.EqualFold(uri.Scheme, "sips") {
+		return nil, errors.New("SIPS is not supported: " + uri.String())
+	}
+	resolver := s.resolver()
+	host := strings.Trim(uri.Host, "[]")
+	numeric := net.ParseIP(host) != nil
+
+	transport, explicit := uri.Params.Get("transport")
+	transport = strings.ToLower(transport)
+	if !explicit && (numeric || uri.Port != 0) {
+		transport = s.defaultTransport()
+	}
+	if transport != "" && !isLocateTransport(transport) {
+		return nil, errors.New("Unsupported transport " + transport + " for " + uri.String())
+	}
+
+	if numeric {
+		port := uri.Port
+		if port == 0 {
+			port = defaultPort(transport)
+		}
+		return []Connectinfo{{transport, host, port}}, nil
+	}
+	if uri.Port != 0 {
+		return addressesOf(ctx, resolver, transport, host, uri.Port)
+	}
+
+	var servers []srvServer
+	var err error
+	if transport == "" {
+		servers, err = naptrServers(ctx, resolver, host)
+		if len(servers) == 0 {
+			for _, t := range locateTransports {
+				servers = append(servers, srvServers(ctx, resolver, t, srvPrefixes[t]+host)...)
+			}
+		}
+	} else {
+		servers = srvServers(ctx, resolver, transport, srvPrefixes[transport]+host)
+	}
+	if len(servers) == 0 {
+		if transport == "" {
+			transport = s.defaultTransport()
+		}
+		return addressesOf(ctx, resolver, transport, host, defaultPort(transport))
+	}
+
+	var targets []Connectinfo
+	for _, server := range servers {
+		if server.Target == "." {
+			continue
+		}
+		addresses, lookupErr := addressesOf(ctx, resolver, server.transport, server.Target, int(server.Port))
+		if lookupErr != nil {
+			err = lookupErr
+			continue
+		}
+		targets = append(targets, addresses...)
+	}
+	if len(targets) == 0 {
+		if err == nil {
+			err = errors.New("No servers for " + uri.String())
+		}
+		return nil, err
+	}
+	return targets, nil
+}
+
+// srvServer is an SRV record with the transport it was looked up for.
+type srvServer struct {
+	*net.SRV
+	transport string
+}
+
+// naptrServers looks up the NAPTR records of domain and returns the SRV
+// records of the usable ones, in order.
+func naptrServers(ctx context.Context, resolver Resolver, domain string) ([]srvServer, error) {
+	records, err := resolver.LookupNAPTR(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Order != records[j].Order {
+			return records[i].Order < records[j].Order
+		}
+		return records[i].Preference < records[j].Preference
+	})
+	var servers []srvServer
+	for _, record := range records {
+		transport, ok := naptrServices[strings.ToUpper(record.Service)]
+		if !ok || !strings.EqualFold(record.Flags, "s") || !isLocateTransport(transport) {
+			continue
+		}
+		servers = append(servers, srvServers(ctx, resolver, transport, record.Replacement)...)
+	}
+	return servers, nil
+}
+
+func srvServers(ctx context.Context, resolver Resolver, transport string, name string) []srvServer {
+	records, err := resolver.LookupSRV(ctx, name)
+	if err != nil {
+		return nil
+	}
+	var servers []srvServer
+	for _, record := range orderSRV(records) {
+		servers = append(servers, srvServer{record, transport})
+	}
+	return servers
+}
+
+// orderSRV sorts records by priority, and randomly by weight within the
+// same priority (RFC 2782).
+func orderSRV(records []*net.SRV) []*net.SRV {
+	sorted := append([]*net.SRV{}, records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+	var ordered []*net.SRV
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		group := append([]*net.SRV{}, sorted[start:end]...)
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Weight == 0 && group[j].Weight != 0
+		})
+		for len(group) > 0 {
+			total := 0
+			for _, record := range group {
+				total += int(record.Weight)
+			}
+			pick := rand.Intn(total + 1)
+			i, sum := 0, 0
+			for ; i < len(group)-1; i++ {
+				sum += int(group[i].Weight)
+				if sum >= pick {
+					break
+				}
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+func addressesOf(ctx context.Context, resolver Resolver, transport string, host string, port int) ([]Connectinfo, error) {
+	addresses, err := resolver.LookupIPAddr(ctx, strings.TrimSuffix(host, "."))
+	if err != nil {
+		return nil, err
+	}
+	var targets []Connectinfo
+	for _, address := range addresses {
+		targets = append(targets, Connectinfo{transport, address.IP.String(), port})
+	}
+	return targets, nil
+}
+
+// dialAny connects to the first of targets which accepts the connection.
+func (s *SipClient) dialAny(ctx context.Context, targets []Connectinfo) (*clientConnection, error) {
+	err := errors.New("No servers to connect to")
+	for _, target := range targets {
+		var conn *clientConnection
+		conn, err = s.dial(ctx, target)
+		if err == nil {
+			return conn, nil
+		}
+		log.Println("Error connecting to ", target.Host, ": ", err)
+	}
+	return nil, err
+}
+
+// dialUri locates the servers of uri and connects to the first one
+// available.
+func (s *SipClient) dialUri(ctx context.Context, uri SipUri) (*clientConnection, error) {
+	targets, err := s.Locate(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	return s.dialAny(ctx, targets)
+}
+
+// registrarUri returns the URI of the registrar at registrar, with its
+// transport if one is set.
+func registrarUri(registrar Connectinfo) string {
+	uri := "sip:" + joinHostPort(registrar.Host, registrar.Port)
+	if registrar.Transport != "" {
+		uri += ";transport=" + strings.ToLower(registrar.Transport)
+	}
+	return uri
+}
@@ -0,0 +1,363 @@
+package sip
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dnsRecord struct {
+	rtype uint16
+	rdata []byte
+}
+
+func encodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func naptrData(order, preference uint16, flags, service, replacement string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, order)
+	b = binary.BigEndian.AppendUint16(b, preference)
+	for _, s := range []string{flags, service, ""} {
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return append(b, encodeName(replacement)...)
+}
+
+func srvData(priority, weight, port uint16, target string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, priority)
+	b = binary.BigEndian.AppendUint16(b, weight)
+	b = binary.BigEndian.AppendUint16(b, port)
+	return append(b, encodeName(target)...)
+}
+
+// startDNSServer answers queries from zone on a local UDP port and
+// returns its address.
+func startDNSServer(t *testing.T, zone map[string][]dnsRecord) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			name, offset, err := readDNSName(query, 12)
+			if err != nil {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(query[offset:])
+			response := append([]byte{}, query[:offset+4]...)
+			response[2] = 0x81
+			response[3] = 0x80
+			records, ok := zone[strings.ToLower(name)]
+			if !ok {
+				response[3] |= 3
+			}
+			var answers []dnsRecord
+			for _, r := range records {
+				if r.rtype == qtype {
+					answers = append(answers, r)
+				}
+			}
+			binary.BigEndian.PutUint16(response[6:], uint16(len(answers)))
+			binary.BigEndian.PutUint16(response[8:], 0)
+			binary.BigEndian.PutUint16(response[10:], 0)
+			for _, a := range answers {
+				response = append(response, 0xc0, 12)
+				response = binary.BigEndian.AppendUint16(response, a.rtype)
+				response = binary.BigEndian.AppendUint16(response, 1)
+				response = binary.BigEndian.AppendUint32(response, 60)
+				response = binary.BigEndian.AppendUint16(response, uint16(len(a.rdata)))
+				response = append(response, a.rdata...)
+			}
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestLocate(t *testing.T) {
+	server := startDNSServer(t, map[string][]dnsRecord{
+		"example.com.": {
+			{35, naptrData(10, 50, "s", "SIP+D2U", "_sip._udp.example.com.")},
+			{35, naptrData(5, 50, "s", "SIP+D2T", "_sip._tcp.example.com.")},
+			{35, naptrData(1, 50, "s", "SIPS+D2T", "_sips._tcp.example.com.")},
+		},
+		"_sip._tcp.example.com.": {
+			{33, srvData(20, 0, 5070, "b.example.com.")},
+			{33, srvData(10, 0, 5080, "a.example.com.")},
+		},
+		"_sip._udp.example.com.": {
+			{33, srvData(10, 0, 5090, "a.example.com.")},
+		},
+		"a.example.com.": {{1, []byte{127, 0, 0, 2}}},
+		"b.example.com.": {{1, []byte{127, 0, 0, 3}}},
+	})
+	s := CreateClient()
+	s.Resolver = &DNSResolver{Server: server}
+
+	checkLocate(t, &s, []locateTest{
+		// NAPTR, then SRV; sips is skipped for a sip URI.
+		{"sip:alice@example.com", []Connectinfo{{"tcp", "127.0.0.2", 5080}, {"tcp", "127.0.0.3", 5070}, {"udp", "127.0.0.2", 5090}}},
+		{"sip:alice@example.com;transport=udp", []Connectinfo{{"udp", "127.0.0.2", 5090}}},
+		{"sip:alice@a.example.com:6000", []Connectinfo{{"tcp", "127.0.0.2", 6000}}},
+		{"sip:b.example.com", []Connectinfo{{"tcp", "127.0.0.3", 5060}}},
+		{"sip:alice@192.0.2.1", []Connectinfo{{"tcp", "192.0.2.1", 5060}}},
+	})
+}
+
+type locateTest struct {
+	uri  string
+	want []Connectinfo
+}
+
+func checkLocate(t *testing.T, s *SipClient, tests []locateTest) {
+	for _, test := range tests {
+		uri, err := ParseUri(test.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets, err := s.Locate(context.Background(), uri)
+		if err != nil {
+			t.Errorf("%s: %v", test.uri, err)
+			continue
+		}
+		if len(targets) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.uri, targets, test.want)
+			continue
+		}
+		for i := range targets {
+			if targets[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.uri, targets, test.want)
+				break
+			}
+		}
+	}
+}
+
+// TestLocateFallback locates servers without NAPTR records: by SRV
+// records of every transport, else by the addresses of the domain, with
+// the default port and transport.
+func TestLocateFallback(t *testing.T) {
+	s := CreateClient()
+	s.Resolver = mapResolver{
+		srv: map[string][]*net.SRV{
+			"_sip._tcp.srv.test": {{Target: "a.test.", Port: 5070, Priority: 1, Weight: 10}},
+			"_sip._udp.srv.test": {{Target: "b.test.", Port: 5080, Priority: 1, Weight: 10}},
+		},
+		ip: map[string][]net.IPAddr{
+			"a.test":     {{IP: net.ParseIP("127.0.0.2")}},
+			"b.test":     {{IP: net.ParseIP("::1")}},
+			"srv.test":   {{IP: net.ParseIP("127.0.0.5")}},
+			"plain.test": {{IP: net.ParseIP("127.0.0.4")}, {IP: net.ParseIP("2001:db8::4")}},
+		},
+	}
+	checkLocate(t, &s, []locateTest{
+		{"sip:srv.test", []Connectinfo{{"tcp", "127.0.0.2", 5070}, {"udp", "::1", 5080}}},
+		{"sip:srv.test;transport=udp", []Connectinfo{{"udp", "::1", 5080}}},
+		// An explicit port skips SRV.
+		{"sip:srv.test:6000", []Connectinfo{{"tcp", "127.0.0.5", 6000}}},
+		{"sip:plain.test", []Connectinfo{{"tcp", "127.0.0.4", 5060}, {"tcp", "2001:db8::4", 5060}}},
+		{"sip:plain.test;transport=udp", []Connectinfo{{"udp", "127.0.0.4", 5060}, {"udp", "2001:db8::4", 5060}}},
+		{"sip:[2001:db8::1]", []Connectinfo{{"tcp", "2001:db8::1", 5060}}},
+		{"sip:[2001:db8::1]:5090;transport=udp", []Connectinfo{{"udp", "2001:db8::1", 5090}}},
+	})
+
+	s.DefaultTransport = "UDP"
+	checkLocate(t, &s, []locateTest{
+		{"sip:plain.test", []Connectinfo{{"udp", "127.0.0.4", 5060}, {"udp", "2001:db8::4", 5060}}},
+		{"sip:192.0.2.1:5070", []Connectinfo{{"udp", "192.0.2.1", 5070}}},
+	})
+
+	for _, uri := range []string{"sips:alice@srv.test", "sip:srv.test;transport=sctp"} {
+		parsed, _ := ParseUri(uri)
+		if targets, err := s.Locate(context.Background(), parsed); err == nil {
+			t.Errorf("%s: got %v, expected an error", uri, targets)
+		}
+	}
+}
+
+// mapResolver is a Resolver without NAPTR records.
+type mapResolver struct {
+	srv map[string][]*net.SRV
+	ip  map[string][]net.IPAddr
+}
+
+func (m mapResolver) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error) {
+	return nil, nil
+}
+
+func (m mapResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	return m.srv[name], nil
+}
+
+func (m mapResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return m.ip[host], nil
+}
+
+// failoverResolver locates failover.test at the ports, in order.
+func failoverResolver(transport string, ports ...int) Resolver {
+	m := mapResolver{
+		srv: map[string][]*net.SRV{},
+		ip:  map[string][]net.IPAddr{"server.test": {{IP: net.ParseIP("127.0.0.1")}}},
+	}
+	name := srvPrefixes[transport] + "failover.test"
+	for i, port := range ports {
+		m.srv[name] = append(m.srv[name], &net.SRV{Target: "server.test.", Port: uint16(port), Priority: uint16(i + 1), Weight: 10})
+	}
+	return m
+}
+
+func TestDialFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	s := CreateClient()
+	s.Resolver = failoverResolver("tcp", 1, l.Addr().(*net.TCPAddr).Port)
+	uri, _ := ParseUri("sip:failover.test")
+	conn, err := s.dialUri(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.close()
+}
+
+// udpServer counts the requests it receives and answers them with code,
+// 200 by default, and Expires: 1 if it is not silent.
+type udpServer struct {
+	port     int
+	mutex    sync.Mutex
+	requests int
+	silent   bool
+	code     int
+}
+
+func startUDPServer(t *testing.T, silent bool) *udpServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	u := &udpServer{port: conn.LocalAddr().(*net.UDPAddr).Port, silent: silent, code: 200}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, err := ParseMessage(append([]byte{}, buf[:n]...))
+			if err != nil || m.GetType() != REQUEST {
+				continue
+			}
+			u.mutex.Lock()
+			u.requests++
+			silent, code := u.silent, u.code
+			u.mutex.Unlock()
+			if silent {
+				continue
+			}
+			response := CreateResponseTo(m, code, ReasonPhrase(code))
+			response.AddHeader("Expires", "1")
+			response.SetContentLength(0)
+			b, _ := response.MarshalBinary()
+			conn.WriteTo(b, addr)
+		}
+	}()
+	return u
+}
+
+func (u *udpServer) setSilent(silent bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.silent = silent
+}
+
+func (u *udpServer) setCode(code int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.code = code
+}
+
+func (u *udpServer) received() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.requests
+}
+
+func TestTimeoutFailover(t *testing.T) {
+	defer func(timeout time.Duration) { TransactionTimeout = timeout }(TransactionTimeout)
+	TransactionTimeout = 300 * time.Millisecond
+
+	silent := startUDPServer(t, true)
+	answering := startUDPServer(t, false)
+	s := CreateClient()
+	s.Resolver = failoverResolver("udp", silent.port, answering.port)
+	info := &RegisterInfo{
+		Registrar: Connectinfo{Transport: "udp", Host: "failover.test"},
+		Client:    Connectinfo{"udp", "127.0.0.1", 5060},
+		Username:  "alice",
+		UserInfo:  UnauthorizedUserInfo("alice"),
+	}
+
+	response, err := s.Ping(context.Background(), info, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := response.Headline.(ResponseHeadline).Code; code != 200 {
+		t.Fatal(code)
+	}
+	if silent.received() != 1 || answering.received() != 1 {
+		t.Fatal("requests: ", silent.received(), answering.received())
+	}
+
+	r := newRegistration(&s, "alice", info)
+	result, _, err := s.register(context.Background(), r, false)
+	if err != nil || result != OKAY {
+		t.Fatal(result, err)
+	}
+	if silent.received() != 2 || answering.received() != 2 {
+		t.Fatal("requests: ", silent.received(), answering.received())
+	}
+}
+
+func TestOrderSRVWeights(t *testing.T) {
+	counts := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		records := orderSRV([]*net.SRV{
+			{Target: "low", Priority: 2, Weight: 100},
+			{Target: "a", Priority: 1, Weight: 90},
+			{Target: "b", Priority: 1, Weight: 10},
+		})
+		if records[2].Target != "low" {
+			t.Fatal("lower priority ordered first")
+		}
+		counts[records[0].Target]++
+	}
+	if counts["a"] < 1600 || counts["b"] < 100 {
+		t.Fatal(counts)
+	}
+}
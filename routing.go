@@ -0,0 +1,182 @@
+package sip
+
+import "strings"
+
+// Routes returns the Route entries of the message, topmost first.
+func (m *Message) Routes() ([]Address, error) {
+	return m.addresses("Route")
+}
+
+// RecordRoutes returns the Record-Route entries of the message, topmost
+// first.
+func (m *Message) RecordRoutes() ([]Address, error) {
+	return m.addresses("Record-Route")
+}
+
+func (m *Message) addresses(name string) ([]Address, error) {
+	var addresses []Address
+	for _, header := range m.Headers.FindHeadersByName(name) {
+		parsed, err := ParseAddressList(header.Value)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, parsed...)
+	}
+	return addresses, nil
+}
+
+// SetRoutes replaces the Route headers of the message.
+func (m *Message) SetRoutes(routes []Address) *Message {
+	m.Headers.RemoveHeader("Route")
+	for _, route := range routes {
+		m.Headers.AddHeader("Route", route.String())
+	}
+	return m
+}
+
+// looseRoute returns the URI of a loose router at c, as used in Route
+// and Record-Route.
+func looseRoute(c Connectinfo) SipUri {
+	return SipUri{
+		Scheme: "sip",
+		Host:   c.Host,
+		Port:   c.Port,
+		Params: Params{{"transport", strings.ToLower(c.Transport)}, {"lr", ""}},
+	}
+}
+
+func isLooseRoute(route Address) bool {
+	return route.Uri.Params.Has("lr")
+}
+
+// applyRoutes sets the Request-URI and Route headers of req for target
+// and routes (RFC 3261, sections 12.2.1.1 and 16.6, step 7). If the first
+// route is a strict router, it becomes the Request-URI and target is
+// appended to the routes. The URI of the next hop is returned.
+func applyRoutes(req *Message, target SipUri, routes []Address) SipUri {
+	method := req.Headline.(RequestHeadline).Method
+	version := req.Headline.(RequestHeadline).Version
+	if len(routes) > 0 && !isLooseRoute(routes[0]) {
+		strict := routes[0].Uri
+		routes = append(append([]Address{}, routes[1:]...), Address{Uri: target})
+		req.Headline = CreateRequestHeadline(method, strict, version)
+		req.SetRoutes(routes)
+		return strict
+	}
+	req.Headline = CreateRequestHeadline(method, target, version)
+	req.SetRoutes(routes)
+	if len(routes) > 0 {
+		return routes[0].Uri
+	}
+	return target
+}
+
+// DialogState is what a user agent remembers of a dialog to send
+// requests within it (RFC 3261, section 12): the identifiers, the remote
+// target and the route set learned from Record-Route.
+type DialogState struct {
+	CallID       string
+	LocalTag     string
+	RemoteTag    string
+	LocalUri     Address
+	RemoteUri    Address
+	LocalCSeq    uint32
+	RemoteTarget SipUri
+	RouteSet     []Address
+
+	// Local is where we receive requests, used for Via.
+	Local Connectinfo
+}
+
+// NewUacDialogState creates the dialog established by response, a 2xx
+// or 1xx with To tag to our request req. The route set is the reversed
+// Record-Route of the response.
+func NewUacDialogState(req *Message, response *Message) (*DialogState, error) {
+	from, err := req.FromAddress()
+	if err != nil {
+		return nil, err
+	}
+	to, err := response.ToAddress()
+	if err != nil {
+		return nil, err
+	}
+	recordRoutes, err := response.RecordRoutes()
+	if err != nil {
+		return nil, err
+	}
+	d := &DialogState{
+		CallID:    req.GetCallId(),
+		LocalTag:  from.Tag(),
+		RemoteTag: to.Tag(),
+		LocalUri:  from,
+		RemoteUri: to,
+	}
+	d.LocalCSeq, _ = req.GetCSeq()
+	for i := len(recordRoutes) - 1; i >= 0; i-- {
+		d.RouteSet = append(d.RouteSet, recordRoutes[i])
+	}
+	if contacts, err := response.Contacts(); err == nil && len(contacts) > 0 {
+		d.RemoteTarget = contacts[0].Uri
+	}
+	if vias, err := req.Vias(); err == nil && len(vias) > 0 {
+		d.Local = Connectinfo{vias[0].Transport, vias[0].Host, vias[0].Port}
+	}
+	return d, nil
+}
+
+// NewUasDialogState creates the dialog established by our response to
+// req. The route set is the Record-Route of the request.
+func NewUasDialogState(req *Message, response *Message, local Connectinfo) (*DialogState, error) {
+	from, err := req.FromAddress()
+	if err != nil {
+		return nil, err
+	}
+	to, err := response.ToAddress()
+	if err != nil {
+		return nil, err
+	}
+	recordRoutes, err := req.RecordRoutes()
+	if err != nil {
+		return nil, err
+	}
+	d := &DialogState{
+		CallID:    req.GetCallId(),
+		LocalTag:  to.Tag(),
+		RemoteTag: from.Tag(),
+		LocalUri:  to,
+		RemoteUri: from,
+		RouteSet:  recordRoutes,
+		Local:     local,
+	}
+	if contacts, err := req.Contacts(); err == nil && len(contacts) > 0 {
+		d.RemoteTarget = contacts[0].Uri
+	}
+	return d, nil
+}
+
+// NewRequest creates a request within the dialog, e.g. a BYE, re-INVITE
+// or the ACK of a 2xx, which keeps the CSeq of the INVITE. It returns
+// the request and where to send it.
+func (d *DialogState) NewRequest(method string) (Message, Connectinfo) {
+	if method != "ACK" && method != "CANCEL" {
+		d.LocalCSeq++
+	}
+	c := CreateRequest(method, "")
+	hop := applyRoutes(&c, d.RemoteTarget, d.RouteSet)
+	c.SetVia(d.Local.Transport, d.Local.Host, d.Local.Port, RandSeq(10))
+
+	local := d.LocalUri
+	local.Params = append(Params{}, local.Params...)
+	local.Params.Set("tag", d.LocalTag)
+	c.SetFromValue(local.String())
+	remote := d.RemoteUri
+	remote.Params = append(Params{}, remote.Params...)
+	if d.RemoteTag != "" {
+		remote.Params.Set("tag", d.RemoteTag)
+	}
+	c.SetToValue(remote.String())
+	c.SetCallId(d.CallID)
+	c.SetCSeq(d.LocalCSeq, method)
+	c.SetMaxForwards(70)
+	return c, destinationOf(hop)
+}
@@ -0,0 +1,230 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ---------------
+type SdpField struct {
+	Type  byte
+	Value string
+}
+
+type SdpFields []SdpField
+
+func (f SdpFields) Get(fieldType byte) (string, bool) {
+	for _, crt := range f {
+		if crt.Type == fieldType {
+			return crt.Value, true
+		}
+	}
+	return "", false
+}
+
+// Attribute returns the value of the first "a=name:value" or "a=name"
+// line. The boolean reports whether the attribute is present.
+func (f SdpFields) Attribute(name string) (string, bool) {
+	for _, crt := range f {
+		if crt.Type != 'a' {
+			continue
+		}
+		nameValue := strings.SplitN(crt.Value, ":", 2)
+		if nameValue[0] == name {
+			if len(nameValue) == 2 {
+				return nameValue[1], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+type SdpConnection struct {
+	NetType  string
+	AddrType string
+	Address  string
+}
+
+// NewSdpConnection returns the connection line for the unicast IPv4 or
+// IPv6 address.
+func NewSdpConnection(address string) SdpConnection {
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if strings.Contains(address, ":") {
+		return SdpConnection{"IN", "IP6", address}
+	}
+	return SdpConnection{"IN", "IP4", address}
+}
+
+func ParseSdpConnection(value string) (SdpConnection, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return SdpConnection{}, errors.New("Malformed connection line: " + value)
+	}
+	return SdpConnection{fields[0], fields[1], fields[2]}, nil
+}
+
+func (c SdpConnection) String() string {
+	return c.NetType + " " + c.AddrType + " " + c.Address
+}
+
+// IP returns the address of a unicast IP4 or IP6 connection, nil if it is
+// not one.
+func (c SdpConnection) IP() net.IP {
+	if c.NetType != "IN" || (c.AddrType != "IP4" && c.AddrType != "IP6") {
+		return nil
+	}
+	ip := net.ParseIP(c.Address)
+	if ip == nil || (ip.To4() != nil) != (c.AddrType == "IP4") {
+		return nil
+	}
+	return ip
+}
+
+// ---------------
+
+// SdpMedia is a media description. PortCount is the number of ports
+// after the port, e.g. 2 for "49170/2", and 0 if none is given.
+type SdpMedia struct {
+	Media     string
+	Port      int
+	PortCount int
+	Proto     string
+	Formats   []string
+	Fields    SdpFields
+}
+
+// Connection returns the media level connection, falling back to the
+// session level one.
+func (m *SdpMedia) Connection(session *SessionDescription) (SdpConnection, error) {
+	if value, ok := m.Fields.Get('c'); ok {
+		return ParseSdpConnection(value)
+	}
+	return session.Connection()
+}
+
+// ---------------
+
+// SessionDescription is an application/sdp body (RFC 4566). Session level
+// lines are kept in order in Fields, each m= section in Media.
+type SessionDescription struct {
+	Fields SdpFields
+	Media  []SdpMedia
+}
+
+func ParseSessionDescription(data []byte) (*SessionDescription, error) {
+	s := &SessionDescription{}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[1] != '=' {
+			return nil, errors.New("Malformed SDP line: " + line)
+		}
+		field := SdpField{line[0], line[2:]}
+		if field.Type == 'm' {
+			media, err := parseSdpMedia(field.Value)
+			if err != nil {
+				return nil, err
+			}
+			s.Media = append(s.Media, media)
+			continue
+		}
+		if len(s.Media) > 0 {
+			crtMedia := &s.Media[len(s.Media)-1]
+			crtMedia.Fields = append(crtMedia.Fields, field)
+		} else {
+			s.Fields = append(s.Fields, field)
+		}
+	}
+	if len(s.Fields) == 0 || s.Fields[0].Type != 'v' {
+		return nil, errors.New("SDP must start with a v= line")
+	}
+	return s, nil
+}
+
+func parseSdpMedia(value string) (SdpMedia, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return SdpMedia{}, errors.New("Malformed media line: " + value)
+	}
+	portAndCount := strings.SplitN(fields[1], "/", 2)
+	port, err := strconv.Atoi(portAndCount[0])
+	if err != nil {
+		return SdpMedia{}, errors.New("Malformed media port: " + value)
+	}
+	portCount := 0
+	if len(portAndCount) == 2 {
+		portCount, err = strconv.Atoi(portAndCount[1])
+		if err != nil || portCount <= 0 {
+			return SdpMedia{}, errors.New("Malformed media port count: " + value)
+		}
+	}
+	return SdpMedia{
+		Media:     fields[0],
+		Port:      port,
+		PortCount: portCount,
+		Proto:     fields[2],
+		Formats:   fields[3:],
+	}, nil
+}
+
+func decodeSessionDescription(contentType ContentType, data []byte) (MessageBody, error) {
+	return ParseSessionDescription(data)
+}
+
+func (s *SessionDescription) Connection() (SdpConnection, error) {
+	value, ok := s.Fields.Get('c')
+	if !ok {
+		return SdpConnection{}, errors.New("No connection line")
+	}
+	return ParseSdpConnection(value)
+}
+
+// SetConnection replaces the session level connection line, e.g. with
+// NewSdpConnection.
+func (s *SessionDescription) SetConnection(c SdpConnection) {
+	field := SdpField{'c', c.String()}
+	for i, crt := range s.Fields {
+		if crt.Type == 'c' {
+			s.Fields[i] = field
+			return
+		}
+	}
+	// c= comes before the b=, t=, z=, k= and a= lines (RFC 4566, section 5).
+	position := len(s.Fields)
+	for i, crt := range s.Fields {
+		if strings.IndexByte("btzka", crt.Type) >= 0 {
+			position = i
+			break
+		}
+	}
+	s.Fields = append(s.Fields[:position], append(SdpFields{field}, s.Fields[position:]...)...)
+}
+
+func (s *SessionDescription) ContentType() ContentType {
+	return ContentType{MediaType: "application/sdp"}
+}
+
+func (s *SessionDescription) MarshalBody() ([]byte, error) {
+	var b bytes.Buffer
+	for _, field := range s.Fields {
+		b.WriteString(string(field.Type) + "=" + field.Value + "\r\n")
+	}
+	for _, media := range s.Media {
+		port := strconv.Itoa(media.Port)
+		if media.PortCount > 0 {
+			port += "/" + strconv.Itoa(media.PortCount)
+		}
+		mediaLine := []string{media.Media, port, media.Proto}
+		b.WriteString("m=" + strings.Join(append(mediaLine, media.Formats...), " ") + "\r\n")
+		for _, field := range media.Fields {
+			b.WriteString(string(field.Type) + "=" + field.Value + "\r\n")
+		}
+	}
+	return b.Bytes(), nil
+}
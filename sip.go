@@ -1,16 +1,18 @@
 package sip
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
-	"strconv"
-	"time"
+	"sync"
 )
 
 type RegistrationResult int
 
+const maxRegisterAttempts = 4
+
 const (
 	OKAY RegistrationResult = iota
 	UNAUTHORIZED
@@ -21,14 +23,43 @@ type SipClient struct {
 	socket           net.Conn
 	Listeners        map[string]*Listener
 	DefaultTransport string
+	Limits           ParserLimits
+	RetryPolicy      RetryPolicy
 	done             chan int
 
+	// OutboundProxy, if its Host is set, receives the requests of all
+	// accounts which have no OutboundProxy of their own, with a
+	// preloaded Route header.
+	OutboundProxy Connectinfo
+
+	// Connections holds the connections to peers, which are reused for
+	// all requests to the same address.
+	Connections *ConnectionManager
+
+	// Resolver locates the servers of SIP URIs. DefaultResolver is used
+	// if it is nil.
+	Resolver Resolver
+
+	// Authenticator, if set, challenges incoming requests before they are
+	// dispatched. ACK and CANCEL cannot be challenged and are let through.
+	Authenticator *Authenticator
+
+	// Registrar, if set, answers incoming REGISTER requests. It
+	// authenticates them with its own Authenticator.
+	Registrar *Registrar
+
+	// Proxy, if set, forwards all other incoming requests instead of
+	// answering them as a user agent.
+	Proxy *Proxy
+
 	callCallback   CallCallback
 	cancelCallback CallCallback
 
-	registerInfo             *RegisterInfo
-	keepRegistering          bool
-	cancelRegistrationSignal chan bool
+	registrations map[string]*Registration
+	pingers       map[*Pinger]bool
+	invites       map[string]*serverInvite
+	challenges    *challengeCache
+	mutex         *sync.Mutex
 }
 type Call struct {
 	From string
@@ -37,12 +68,21 @@ type CallCallback func(*Call)
 
 func CreateClient() SipClient {
 	s := SipClient{}
-	s.cancelRegistrationSignal = make(chan bool, 1)
+	s.mutex = &sync.Mutex{}
+	s.registrations = make(map[string]*Registration)
+	s.invites = make(map[string]*serverInvite)
+	s.challenges = newChallengeCache()
 	// DEFAULTS:
 	s.Listeners = make(map[string]*Listener)
+	s.Limits = DefaultParserLimits
+	s.RetryPolicy = DefaultRetryPolicy
+	s.Connections = NewConnectionManager()
 	return s
 }
 
+// Listen accepts connections on host and port. IPv6 addresses may be
+// given with or without brackets; an empty host or "::" listens on all
+// IPv4 and IPv6 addresses.
 func (s *SipClient) Listen(transport string, host string, port int) error {
 	id := fmt.Sprintf("%s_%s_%d", transport, host, port)
 	_, alreadyThere := s.Listeners[id]
@@ -50,39 +90,8 @@ func (s *SipClient) Listen(transport string, host string, port int) error {
 		return errors.New("Already accepting connections on this Listener")
 	}
 
-	//	var err error
-	var dialogListener func(d *Dialog) = func(d *Dialog) {
-		d.OnMessage(func(m *Message) {
-			switch m.GetType() {
-			case REQUEST:
-				requestHeadline, ok := m.Headline.(RequestHeadline)
-				if ok {
-					switch requestHeadline.Method {
-					case "INVITE":
-						d.Reply100Trying()
-						d.Reply180Ringing()
-
-						c := Call{}
-						c.From = m.GetFrom()
-
-						if s.callCallback != nil {
-							s.callCallback(&c)
-						}
-					case "CANCEL":
-						d.Reply200Ok()
-						c := Call{}
-						c.From = m.GetFrom()
-						if s.cancelCallback != nil {
-							s.cancelCallback(&c)
-						}
-					default:
-
-						log.Println("Message is:", requestHeadline.Method)
-					}
-				}
-
-			}
-		})
+	dialogListener := func(d *Dialog) {
+		s.Connections.adopt(s, d, transport)
 	}
 
 	l := CreateListener(transport, host, port, s, dialogListener)
@@ -92,187 +101,218 @@ func (s *SipClient) Listen(transport string, host string, port int) error {
 	return nil
 }
 
+// handleRequest dispatches a request received on d, on a listener or an
+// outgoing flow.
+func (s *SipClient) handleRequest(d *Dialog, m *Message) {
+	requestHeadline, ok := m.Headline.(RequestHeadline)
+	if ok && requestHeadline.Method == "REGISTER" && s.Registrar != nil {
+		d.sendMessage(s.Registrar.HandleRegister(m))
+		return
+	}
+	if ok && s.Authenticator != nil && requestHeadline.Method != "ACK" && requestHeadline.Method != "CANCEL" {
+		if _, challenge := s.Authenticator.Authenticate(m); challenge != nil {
+			d.sendMessage(challenge)
+			return
+		}
+	}
+	if ok && s.Proxy != nil {
+		s.Proxy.HandleRequest(d, m)
+		return
+	}
+	if ok {
+		switch requestHeadline.Method {
+		case "INVITE":
+			t := s.acceptInvite(d, m)
+			if t == nil {
+				// Retransmission
+				c := CreateResponseTo(m, 100, "Trying")
+				d.sendMessage(&c)
+				return
+			}
+			t.respond(100)
+			t.respond(180)
+
+			if s.callCallback != nil {
+				s.callCallback(t.call)
+			}
+		case "OPTIONS":
+			s.answerOptions(d, m)
+		case "CANCEL":
+			s.cancelInvite(d, m)
+		default:
+
+			log.Println("Message is:", requestHeadline.Method)
+		}
+	}
+}
+
 func (s *SipClient) OnIncomingCall(callback CallCallback) {
 	s.callCallback = callback
 }
+
+// OnCancel sets the callback called with the Call passed to
+// OnIncomingCall when the caller cancels it.
 func (s *SipClient) OnCancel(callback CallCallback) {
 	s.cancelCallback = callback
 }
 
+// StopListeningAll stops all listeners and closes the connections they
+// accepted.
 func (s *SipClient) StopListeningAll() {
-	numRemaining := len(s.Listeners)
-	done := make(chan bool)
-	for i, crtListener := range s.Listeners {
-		go func() {
-			crtListener.Stop()
-			numRemaining--
-			if numRemaining == 0 {
-				done <- true
-			}
-		}()
+	for id, crtListener := range s.Listeners {
 		crtListener.Stop()
-		delete(s.Listeners, i)
+		delete(s.Listeners, id)
 	}
-	_ = <-done
 }
 
-func (s *SipClient) SetDefaultTransport(transport string) {
-	s.DefaultTransport = transport
+// Shutdown stops all listeners, pingers and registrations, without
+// unregistering, and closes all connections.
+func (s *SipClient) Shutdown() {
+	s.StopListeningAll()
+	s.mutex.Lock()
+	registrations := s.registrations
+	s.registrations = make(map[string]*Registration)
+	var pingers []*Pinger
+	for p := range s.pingers {
+		pingers = append(pingers, p)
+	}
+	s.mutex.Unlock()
+	for _, p := range pingers {
+		p.Stop()
+	}
+	for _, r := range registrations {
+		r.stop()
+	}
+	s.Connections.CloseAll()
 }
 
-func (s *SipClient) scheduleRegisterJob() {
-	s.register(s.registerInfo, false)
-	go func() {
-		if s.keepRegistering {
-			select {
-			case <-time.After(time.Duration(s.registerInfo.Expiration) * time.Second):
-				s.scheduleRegisterJob()
-			case <-s.cancelRegistrationSignal:
-				s.keepRegistering = false
-			}
-		}
-	}()
+func (s *SipClient) SetDefaultTransport(transport string) {
+	s.DefaultTransport = transport
 }
 
 func (s *SipClient) TryRegister(registerInfo *RegisterInfo) (RegistrationResult, error) {
-	s.keepRegistering = true
 	log.Println("Register")
-	result, err := s.register(registerInfo, false)
-	if result == OKAY {
-		s.scheduleRegisterJob()
-	}
+	_, result, err := s.startRegistration(context.Background(), registerInfo.AccountID(), registerInfo)
 	return result, err
 }
 
 func (s *SipClient) Deregister(registerInfo *RegisterInfo) (RegistrationResult, error) {
-	s.cancelRegistrationSignal <- true
-	return s.register(registerInfo, true)
-}
-
-func (s *SipClient) register(registerInfo *RegisterInfo, unregister bool) (RegistrationResult, error) {
-	connectInfo := registerInfo.Registrar
-	if connectInfo.Transport == "" {
-		connectInfo.Transport = "tcp"
-	}
-
-	socket, err := net.Dial(connectInfo.Transport, connectInfo.Host+":"+strconv.Itoa(connectInfo.Port))
-	if err != nil {
-		return ERROR, err
+	r, found := s.removeRegistration(registerInfo.AccountID())
+	if found {
+		return r.unregister(context.Background())
 	}
-	dialog := CreateDialog(socket, s)
-	log.Printf("[P] Created: %p\n", dialog)
-	unauthRegResult := make(chan RegistrationResult)
-	var auth WWWAuthenticate
-	var innerErr error
-	dialog.OnMessage(func(m *Message) {
-		if m.GetType() == RESPONSE {
-			responseHeader, ok := m.Headline.(ResponseHeadline)
-			if !ok {
-				log.Println("Error. Type is RESPONSE, but headline is REQUEST")
-				log.Println("Details: ", m)
-				unauthRegResult <- ERROR
-				innerErr = errors.New("Error. Type is RESPONSE, but headline is REQUEST")
-				return
-			}
-			if responseHeader.IsFinal() {
-				finalCode := responseHeader.Code
-				if err != nil {
-					log.Println("Couldn't determine the response code")
-					unauthRegResult <- ERROR
-					return
-				}
-				switch finalCode {
-				case 200:
-					s.registerInfo.Expiration = m.GetExpires() - 2
-					unauthRegResult <- OKAY
-					return
-				case 401:
-					authLine, err := m.Headers.FindHeaderByName("WWW-Authenticate")
-					auth, err = ParseWWWAuthenticate(authLine)
-					if err != nil {
-						log.Println("Error parsing wwwauthenticate: ", err)
-					}
-					unauthRegResult <- UNAUTHORIZED
-					return
-				}
+	result, _, err := s.register(context.Background(), newRegistration(s, "", registerInfo), true)
+	return result, err
+}
 
-			}
+// register sends the REGISTER of r to the outbound proxy or, if there is
+// none, to the servers located for the registrar, trying the next one
+// if a server does not answer (RFC 3263, section 4.3).
+func (s *SipClient) register(ctx context.Context, r *Registration, unregister bool) (RegistrationResult, int, error) {
+	registerInfo := r.info
+	routes, dest := s.outboundRoute(registerInfo, registerInfo.Registrar)
+	targets := []Connectinfo{dest}
+	if routes == nil {
+		uri, err := ParseUri(registrarUri(registerInfo.Registrar))
+		if err != nil {
+			return ERROR, 0, err
+		}
+		targets, err = s.Locate(ctx, uri)
+		if err != nil {
+			return ERROR, 0, err
 		}
-
-	})
-	if !unregister {
-		dialog.SendRegister(registerInfo, nil)
-	} else {
-		dialog.SendDeregister(registerInfo, nil)
-	}
-
-	res := <-unauthRegResult
-	if res == OKAY {
-		return OKAY, nil
-	}
-	if res == ERROR {
-		return ERROR, innerErr
 	}
 
-	if registerInfo.UserInfo.GetType() == "UNAUTHORIZED" {
-		return UNAUTHORIZED, errors.New("Authorization required but not provided")
+	err := errors.New("No servers to connect to")
+	for i, target := range targets {
+		dialCtx, cancel := context.WithTimeout(ctx, TransactionTimeout)
+		var conn *clientConnection
+		conn, err = s.registerConnection(dialCtx, r, target)
+		cancel()
+		if err != nil {
+			log.Println("Error connecting to ", target.Host, ": ", err)
+			continue
+		}
+		var result RegistrationResult
+		var expires int
+		result, expires, err = s.registerOn(ctx, r, conn, routes, unregister)
+		if err != errTransactionTimeout || i == len(targets)-1 {
+			return result, expires, err
+		}
+		log.Println("No response from ", target.Host, ", trying the next server")
 	}
-	// Retry registration with authorization information
-	authRegResult := make(chan RegistrationResult)
-
-	dialog.OnMessage(func(m *Message) {
-		if m.GetType() == RESPONSE {
-			responseHeader, ok := m.Headline.(ResponseHeadline)
-			if !ok {
-				log.Println("Error. Type is RESPONSE, but headline is REQUEST")
-				log.Println("Details: ", m)
-				authRegResult <- ERROR
-				return
-			}
-			if responseHeader.IsFinal() {
-				finalCode := responseHeader.Code
-				if err != nil {
-					log.Println("Couldn't determine the response code")
-					authRegResult <- ERROR
-					return
-				}
-				switch finalCode {
-				case 200:
-					s.registerInfo.Expiration = m.GetExpires() - 2
-					authRegResult <- OKAY
-					return
-				case 401:
-					authRegResult <- UNAUTHORIZED
-					return
-				}
+	return ERROR, 0, err
+}
 
+// registerOn sends the REGISTER of r on conn, which it releases, and
+// answers challenges and 423 responses.
+func (s *SipClient) registerOn(ctx context.Context, r *Registration, conn *clientConnection, routes []Address, unregister bool) (RegistrationResult, int, error) {
+	registerInfo := r.info
+	keep := false
+	defer func() {
+		if !keep {
+			if r.dropFlow(conn) {
+				conn.release()
 			}
+			conn.release()
 		}
+	}()
+	// The connection may be shared, the registration keeps its own
+	// dialog state.
+	dialog := &Dialog{CallID: r.callID, CSeq: r.cseq, Local: r.from, client: s}
+	defer func() {
+		r.cseq = dialog.CSeq
+		r.from = dialog.Local
+	}()
 
-	})
-
-	digestAuth, ok1 := auth.(DigestWWWAuthenticate)
-	userInfo := registerInfo.UserInfo
-	digestAuthInfo, ok2 := userInfo.(*DigestUserInfoImpl)
-	if ok1 && ok2 {
-		authInfo := AuthInformation{
-			digestAuth,
-			userInfo.GetUsername(),
-			digestAuthInfo.GetPassword(),
-			"sip:" + connectInfo.Host,
+	answered := false
+	for attempt := 0; attempt < maxRegisterAttempts; attempt++ {
+		info := *registerInfo
+		info.Expiration = r.requested
+		req := dialog.createRegister(&info, unregister)
+		req.SetRoutes(routes)
+		applyCredentials(&req, s.challenges.credentials(registerInfo.Registrar, registerInfo.UserInfo, &req))
+
+		m, err := conn.transact(ctx, &req, nil, 0)
+		if err != nil {
+			return ERROR, 0, err
 		}
-
-		if !unregister {
-			dialog.SendRegister(registerInfo, &authInfo)
-		} else {
-			dialog.SendDeregister(registerInfo, &authInfo)
+		responseHeader := m.Headline.(ResponseHeadline)
+
+		switch responseHeader.Code {
+		case 200:
+			expires := r.grantedExpires(m)
+			if expires == 0 && !unregister {
+				// The registrar removed the binding right away, which is
+				// retried like a rejection rather than refreshed.
+				return ERROR, 0, errors.New("Registrar granted no expiry")
+			}
+			if registerInfo.usesOutbound() && !unregister {
+				keep = true
+				r.useFlow(conn, m)
+			}
+			return OKAY, expires, nil
+		case 401, 407:
+			if answered && !isStale(m) {
+				s.challenges.forget(registerInfo.Registrar, registerInfo.UserInfo)
+				return UNAUTHORIZED, 0, newRegistrationError(m)
+			}
+			if err := s.challenges.update(registerInfo.Registrar, m, registerInfo.UserInfo); err != nil {
+				return UNAUTHORIZED, 0, err
+			}
+			answered = true
+		case 423:
+			minExpires, err := m.GetMinExpires()
+			if err != nil || minExpires <= r.requested {
+				return ERROR, 0, newRegistrationError(m)
+			}
+			log.Println("Registration interval too brief, retrying with ", minExpires)
+			r.requested = minExpires
+		default:
+			return ERROR, 0, newRegistrationError(m)
 		}
-
-		//dialog.SendRegister(&authInfo, connectInfo)
 	}
-	res2 := <-authRegResult
-
-	return res2, innerErr
+	return ERROR, 0, errors.New("Registration failed after too many attempts")
 }
 
 func (s *SipClient) WaitAll() {
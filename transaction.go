@@ -0,0 +1,300 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// maxAuthAttempts bounds the requests sent by Request, including retries
+// after stale nonces.
+const maxAuthAttempts = 3
+
+func (s *SipClient) dial(ctx context.Context, dest Connectinfo) (*clientConnection, error) {
+	if dest.Transport == "" {
+		dest.Transport = "tcp"
+	}
+	return s.Connections.get(ctx, s, dest)
+}
+
+// errTransactionTimeout is returned by transact if no final response
+// arrived in time.
+var errTransactionTimeout = errors.New("Transaction timed out")
+
+// transact sends req and waits for its final response. Provisional
+// responses are passed to provisional, if not nil, and responses to
+// other requests, e.g. a CANCEL of req, are skipped. Non-2xx final
+// responses to INVITE are acknowledged.
+//
+// A request without final response fails after TransactionTimeout (Timer
+// F), an INVITE only if it got no provisional response either (Timer B).
+// Once an INVITE got one, it is bounded by ctx and, if ringing is not 0,
+// by ringing since the last provisional response (Timer C of a proxy).
+func (c *clientConnection) transact(ctx context.Context, req *Message, provisional func(*Message), ringing time.Duration) (*Message, error) {
+	responses := c.await(req)
+	defer c.forget(req)
+	c.send(req)
+
+	timeout := time.NewTimer(TransactionTimeout)
+	defer timeout.Stop()
+	request := req.Headline.(RequestHeadline)
+
+	// handle returns the final response, or nil for a provisional one.
+	handle := func(m *Message) *Message {
+		responseHeader := m.Headline.(ResponseHeadline)
+		if !responseHeader.IsFinal() {
+			if request.Method == "INVITE" {
+				if !timeout.Stop() {
+					select {
+					case <-timeout.C:
+					default:
+					}
+				}
+				if ringing > 0 {
+					timeout.Reset(ringing)
+				}
+			}
+			if provisional != nil {
+				provisional(m)
+			}
+			return nil
+		}
+		if request.Method == "INVITE" && responseHeader.Code >= 300 {
+			ack := CreateAck(req, m)
+			c.send(&ack)
+		}
+		return m
+	}
+	for {
+		select {
+		case m := <-responses:
+			if final := handle(m); final != nil {
+				return final, nil
+			}
+		case <-c.closed():
+			// Responses may have arrived just before the connection
+			// was closed.
+			for {
+				select {
+				case m := <-responses:
+					if final := handle(m); final != nil {
+						return final, nil
+					}
+				default:
+					return nil, errors.New("Connection closed")
+				}
+			}
+		case <-timeout.C:
+			return nil, errTransactionTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func topBranch(m *Message) string {
+	vias, err := m.Vias()
+	if err != nil || len(vias) == 0 {
+		return ""
+	}
+	return vias[0].Branch()
+}
+
+// CreateAck builds the ACK for a non-2xx final response to invite, which
+// belongs to the INVITE transaction (RFC 3261, section 17.1.1.3).
+func CreateAck(invite *Message, response *Message) Message {
+	ack := CreateRequest("ACK", invite.Headline.(RequestHeadline).Uri.String())
+	vias := invite.Headers.FindHeadersByName("Via")
+	if len(vias) > 0 {
+		ack.Headers.AddHeader("Via", vias[0].Value)
+	}
+	ack.SetFromValue(invite.GetFrom())
+	ack.SetToValue(response.GetTo())
+	ack.SetCallId(invite.GetCallId())
+	cseq, _ := invite.GetCSeq()
+	ack.SetCSeq(cseq, "ACK")
+	for _, route := range invite.Headers.FindHeadersByName("Route") {
+		ack.Headers.AddHeader("Route", route.Value)
+	}
+	ack.SetMaxForwards(70)
+	return ack
+}
+
+// applyCredentials replaces the Authorization and Proxy-Authorization
+// headers of req.
+func applyCredentials(req *Message, credentials []AuthInformation) {
+	if len(credentials) == 0 {
+		return
+	}
+	req.Headers.RemoveHeader("Authorization")
+	req.Headers.RemoveHeader("Proxy-Authorization")
+	for _, authInfo := range credentials {
+		req.SetDigestAuthorizationHeader(authInfo)
+	}
+}
+
+// CreateCancel builds the CANCEL of a pending INVITE, which takes the
+// branch of the INVITE (RFC 3261, section 9.1).
+func CreateCancel(invite *Message) Message {
+	request := invite.Headline.(RequestHeadline)
+	c := CreateRequest("CANCEL", "")
+	c.Headline = CreateRequestHeadline("CANCEL", request.Uri, request.Version)
+	if vias, err := invite.Vias(); err == nil && len(vias) > 0 {
+		c.Headers.AddHeader("Via", vias[0].String())
+	}
+	c.SetFromValue(invite.GetFrom())
+	c.SetToValue(invite.GetTo())
+	c.SetCallId(invite.GetCallId())
+	cseq, _ := invite.GetCSeq()
+	c.SetCSeq(cseq, "CANCEL")
+	for _, route := range invite.Headers.FindHeadersByName("Route") {
+		c.Headers.AddHeader("Route", route.Value)
+	}
+	c.SetMaxForwards(70)
+	return c
+}
+
+func isChallenge(m *Message) bool {
+	responseHeader, ok := m.Headline.(ResponseHeadline)
+	return ok && (responseHeader.Code == 401 || responseHeader.Code == 407)
+}
+
+// Request sends req to dest and returns the final response, nil for an
+// ACK, which has none. 401 and 407 challenges are answered using userInfo
+// and remembered, so that later requests to dest are authorized right
+// away. req is updated to the request last sent, so that it can be used
+// for a later CANCEL or ACK. ctx bounds the whole exchange. A request
+// fails after TransactionTimeout without final response, an INVITE only
+// while it got no provisional response; a ringing INVITE waits until it
+// is answered, cancelled or ctx is done.
+func (s *SipClient) Request(ctx context.Context, dest Connectinfo, req *Message, userInfo UserInfo) (*Message, error) {
+	return s.request(ctx, dest, []Connectinfo{dest}, req, userInfo)
+}
+
+// request is Request, sending req to the first of targets available and
+// to the next one if a server does not answer (RFC 3263, section 4.3).
+// Challenges are remembered for dest.
+func (s *SipClient) request(ctx context.Context, dest Connectinfo, targets []Connectinfo, req *Message, userInfo UserInfo) (*Message, error) {
+	if _, ok := req.Headline.(RequestHeadline); !ok {
+		return nil, errors.New("Not a request")
+	}
+	err := errors.New("No servers to connect to")
+	for i, target := range targets {
+		dialCtx, cancel := context.WithTimeout(ctx, TransactionTimeout)
+		var conn *clientConnection
+		conn, err = s.dial(dialCtx, target)
+		cancel()
+		if err != nil {
+			log.Println("Error connecting to ", target.Host, ": ", err)
+			continue
+		}
+		var response *Message
+		response, err = s.requestOn(ctx, conn, dest, req, userInfo)
+		conn.release()
+		if err != errTransactionTimeout || i == len(targets)-1 {
+			return response, err
+		}
+		log.Println("No response from ", target.Host, ", trying the next server")
+		req.SetTopViaBranch("z9hG4bK" + RandSeq(10))
+	}
+	return nil, err
+}
+
+// requestOn sends req on conn and answers challenges.
+func (s *SipClient) requestOn(ctx context.Context, conn *clientConnection, dest Connectinfo, req *Message, userInfo UserInfo) (*Message, error) {
+	request := req.Headline.(RequestHeadline)
+	if request.Method == "ACK" {
+		conn.send(req)
+		return nil, nil
+	}
+
+	answered := false
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			retry := req.Clone()
+			cseq, method := retry.GetCSeq()
+			retry.SetCSeq(cseq+1, method)
+			retry.SetTopViaBranch("z9hG4bK" + RandSeq(10))
+			*req = retry
+		}
+		if request.Method != "CANCEL" {
+			applyCredentials(req, s.challenges.credentials(dest, userInfo, req))
+		}
+
+		response, err := conn.transact(ctx, req, nil, 0)
+		if err != nil || !isChallenge(response) || userInfo == nil || attempt == maxAuthAttempts {
+			return response, err
+		}
+		if answered && !isStale(response) {
+			s.challenges.forget(dest, userInfo)
+			return response, nil
+		}
+		if err := s.challenges.update(dest, response, userInfo); err != nil {
+			return response, err
+		}
+		answered = true
+	}
+}
+
+// NewRequest creates an out-of-dialog request from this account to
+// target, e.g. an INVITE, SUBSCRIBE or MESSAGE, to be sent with
+// SipClient.Request.
+func (r *RegisterInfo) NewRequest(method string, target string) Message {
+	c := CreateRequest(method, target)
+	c.SetVia(r.Client.Transport, r.Client.Host, r.Client.Port, RandSeq(10))
+	c.SetFrom("sip", r.Username, r.Registrar.Host, RandSeq(10))
+	c.SetToValue("<" + target + ">")
+	c.SetCallId(RandSeq(10))
+	c.SetCSeq(1, method)
+	c.SetMaxForwards(70)
+	c.SetContact("sip", r.Username, r.Client.Host, r.Client.Port)
+	c.SetUserAgent("sipbell/0.1")
+	return c
+}
+
+// outboundRoute returns the preloaded route for requests of the account
+// of info and where to send them: the outbound proxy, or direct if there
+// is none.
+func (s *SipClient) outboundRoute(info *RegisterInfo, direct Connectinfo) ([]Address, Connectinfo) {
+	proxy := info.OutboundProxy
+	if proxy.Host == "" {
+		proxy = s.OutboundProxy
+	}
+	if proxy.Host == "" {
+		return nil, direct
+	}
+	if proxy.Transport == "" {
+		proxy.Transport = "tcp"
+	}
+	if proxy.Port == 0 {
+		proxy.Port = 5060
+	}
+	return []Address{{Uri: looseRoute(proxy)}}, proxy
+}
+
+// SendAs sends req, e.g. created by NewRequest, on behalf of the account
+// of info, answering challenges with its UserInfo. The request goes
+// through the outbound proxy if one is configured, otherwise to the
+// servers located for its first Route or Request-URI.
+func (s *SipClient) SendAs(ctx context.Context, info *RegisterInfo, req *Message) (*Message, error) {
+	request, ok := req.Headline.(RequestHeadline)
+	if !ok {
+		return nil, errors.New("Not a request")
+	}
+	hop := request.Uri
+	existing, _ := req.Routes()
+	if len(existing) > 0 {
+		hop = existing[0].Uri
+	}
+	routes, dest := s.outboundRoute(info, destinationOf(hop))
+	if routes != nil {
+		req.SetRoutes(append(routes, existing...))
+		return s.Request(ctx, dest, req, info.UserInfo)
+	}
+	targets, err := s.Locate(ctx, hop)
+	if err != nil {
+		return nil, err
+	}
+	return s.request(ctx, dest, targets, req, info.UserInfo)
+}
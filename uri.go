@@ -0,0 +1,344 @@
+package sip
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ---------------
+type Param struct {
+	Name  string
+	Value string
+}
+
+type Params []Param
+
+func (p Params) Get(name string) (string, bool) {
+	for _, crt := range p {
+		if strings.EqualFold(crt.Name, name) {
+			return crt.Value, true
+		}
+	}
+	return "", false
+}
+
+func (p Params) Has(name string) bool {
+	_, found := p.Get(name)
+	return found
+}
+
+func (p *Params) Set(name string, value string) {
+	for i, crt := range *p {
+		if strings.EqualFold(crt.Name, name) {
+			(*p)[i].Value = value
+			return
+		}
+	}
+	*p = append(*p, Param{name, value})
+}
+
+func (p *Params) Del(name string) {
+	var kept Params
+	for _, crt := range *p {
+		if !strings.EqualFold(crt.Name, name) {
+			kept = append(kept, crt)
+		}
+	}
+	*p = kept
+}
+
+func (p Params) join(lead string, sep string) string {
+	s := ""
+	for i, crt := range p {
+		if i == 0 {
+			s += lead
+		} else {
+			s += sep
+		}
+		s += crt.Name
+		if crt.Value != "" {
+			s += "=" + crt.Value
+		}
+	}
+	return s
+}
+
+// String returns the parameters in ";name=value" form.
+func (p Params) String() string {
+	return p.join(";", ";")
+}
+
+func parseParams(s string, sep string) (Params, error) {
+	var params Params
+	if s == "" {
+		return params, nil
+	}
+	for _, item := range splitOutside(s, sep) {
+		item = strings.TrimSpace(item)
+		nameValue := strings.SplitN(item, "=", 2)
+		name := strings.TrimSpace(nameValue[0])
+		if name == "" || !isToken(name) {
+			return nil, errors.New("Malformed parameter: " + item)
+		}
+		value := ""
+		if len(nameValue) == 2 {
+			value = strings.TrimSpace(nameValue[1])
+		}
+		params = append(params, Param{name, value})
+	}
+	return params, nil
+}
+
+// ---------------
+
+type SipUri struct {
+	Scheme   string
+	User     string
+	Password string
+	Host     string
+	Port     int
+	Params   Params
+	Headers  Params
+
+	// Opaque holds everything after the scheme for URIs which are not
+	// sip or sips, e.g. tel or mailto.
+	Opaque string
+}
+
+// ParseSipUri is the lenient variant of ParseUri: if uri cannot be
+// parsed it is kept verbatim and returned unchanged by String.
+func ParseSipUri(uri string) SipUri {
+	parsed, err := ParseUri(uri)
+	if err != nil {
+		return SipUri{Opaque: uri}
+	}
+	return parsed
+}
+
+func ParseUri(uri string) (SipUri, error) {
+	u := SipUri{}
+	if strings.ContainsAny(uri, " \t\r\n<>\"") {
+		return u, errors.New("Invalid character in URI: " + uri)
+	}
+	colon := strings.Index(uri, ":")
+	if colon <= 0 || !isScheme(uri[:colon]) {
+		return u, errors.New("Missing or invalid URI scheme: " + uri)
+	}
+	u.Scheme = strings.ToLower(uri[:colon])
+	rest := uri[colon+1:]
+	if rest == "" {
+		return u, errors.New("Empty URI: " + uri)
+	}
+	if !u.IsSip() {
+		u.Opaque = rest
+		return u, nil
+	}
+
+	// The userinfo ends at the first '@'. It may contain ';' and '?',
+	// e.g. "alice;day=tuesday@atlanta.com" (RFC 3261, section 19.1.3),
+	// so an '@' after '?' is only taken for a header value, e.g.
+	// "atlanta.com?Subject=a@b", if a valid host precedes the '?'.
+	at := strings.Index(rest, "@")
+	if question := strings.Index(rest, "?"); question >= 0 && question < at {
+		hostPort := rest[:question]
+		if semicolon := strings.Index(hostPort, ";"); semicolon >= 0 {
+			hostPort = hostPort[:semicolon]
+		}
+		if _, _, err := splitHostPort(hostPort); err == nil {
+			at = -1
+		}
+	}
+	if at >= 0 {
+		userInfo := rest[:at]
+		rest = rest[at+1:]
+		if userPassword := strings.SplitN(userInfo, ":", 2); len(userPassword) == 2 {
+			u.User = userPassword[0]
+			u.Password = userPassword[1]
+		} else {
+			u.User = userInfo
+		}
+		if u.User == "" {
+			return u, errors.New("Empty user part in URI: " + uri)
+		}
+	}
+
+	if question := strings.Index(rest, "?"); question >= 0 {
+		headers, err := parseParams(rest[question+1:], "&")
+		if err != nil {
+			return u, err
+		}
+		u.Headers = headers
+		rest = rest[:question]
+	}
+
+	hostPort := rest
+	if semicolon := strings.Index(rest, ";"); semicolon >= 0 {
+		hostPort = rest[:semicolon]
+		params, err := parseParams(rest[semicolon+1:], ";")
+		if err != nil {
+			return u, err
+		}
+		u.Params = params
+	}
+
+	host, port, err := splitHostPort(hostPort)
+	if err != nil {
+		return u, err
+	}
+	u.Host = host
+	u.Port = port
+	return u, nil
+}
+
+func (s SipUri) IsSip() bool {
+	return s.Scheme == "sip" || s.Scheme == "sips"
+}
+
+func (s SipUri) String() string {
+	if !s.IsSip() {
+		if s.Scheme == "" {
+			return s.Opaque
+		}
+		return s.Scheme + ":" + s.Opaque
+	}
+	uri := s.Scheme + ":"
+	if s.User != "" {
+		uri += s.User
+		if s.Password != "" {
+			uri += ":" + s.Password
+		}
+		uri += "@"
+	}
+	uri += joinHostPort(s.Host, s.Port)
+	uri += s.Params.String()
+	uri += s.Headers.join("?", "&")
+	return uri
+}
+
+// ---------------
+
+func splitHostPort(hostPort string) (host string, port int, err error) {
+	portString := ""
+	if strings.HasPrefix(hostPort, "[") {
+		end := strings.Index(hostPort, "]")
+		if end < 0 {
+			return "", 0, errors.New("Unterminated IPv6 reference: " + hostPort)
+		}
+		host = hostPort[1:end]
+		if !isIPv6Reference(host) {
+			return "", 0, errors.New("Invalid IPv6 reference: " + hostPort)
+		}
+		rest := hostPort[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", 0, errors.New("Invalid host: " + hostPort)
+			}
+			portString = rest[1:]
+		}
+	} else {
+		host = hostPort
+		if colon := strings.Index(hostPort, ":"); colon >= 0 {
+			host = hostPort[:colon]
+			portString = hostPort[colon+1:]
+		}
+		if !isHostname(host) {
+			return "", 0, errors.New("Invalid host: " + hostPort)
+		}
+	}
+	if portString != "" {
+		port, err = strconv.Atoi(portString)
+		if err != nil || port < 0 || port > 65535 || !isDigits(portString) {
+			return "", 0, errors.New("Invalid port: " + hostPort)
+		}
+	}
+	return host, port, nil
+}
+
+// joinHostPort returns host and port as used in URIs and Via, with IPv6
+// addresses in brackets. host may be bracketed already.
+func joinHostPort(host string, port int) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port == 0 {
+		return host
+	}
+	return host + ":" + strconv.Itoa(port)
+}
+
+// netAddress returns host and port as used by net.Dial and net.Listen.
+func netAddress(host string, port int) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+}
+
+// sameHost compares hosts of URIs and Via. IP addresses are equal in any
+// notation, e.g. "[::1]" and "0:0::1".
+func sameHost(a string, b string) bool {
+	a = strings.TrimSuffix(strings.TrimPrefix(a, "["), "]")
+	b = strings.TrimSuffix(strings.TrimPrefix(b, "["), "]")
+	if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return strings.EqualFold(a, b)
+}
+
+func isScheme(s string) bool {
+	for i, c := range s {
+		isAlpha := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if i == 0 && !isAlpha {
+			return false
+		}
+		if !isAlpha && !(c >= '0' && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isHostname(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isIPv6Reference(s string) bool {
+	if !strings.Contains(s, ":") {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') && !(c >= '0' && c <= '9') && c != ':' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isToken(s string) bool {
+	for _, c := range s {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			continue
+		}
+		if !strings.ContainsRune("-.!%*_+`'~", c) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,31 @@
+package sip
+
+import "testing"
+
+func TestParseUriUserInfo(t *testing.T) {
+	tests := []struct {
+		uri     string
+		user    string
+		host    string
+		headers string
+	}{
+		{"sip:alice@atlanta.com", "alice", "atlanta.com", ""},
+		{"sip:alice;day=tuesday@atlanta.com", "alice;day=tuesday", "atlanta.com", ""},
+		{"sip:alice@atlanta.com?Subject=a@b", "alice", "atlanta.com", "a@b"},
+		{"sip:atlanta.com?Subject=a@b", "", "atlanta.com", "a@b"},
+		{"sip:atlanta.com;maddr=239.255.255.1?Subject=a@b", "", "atlanta.com", "a@b"},
+		{"sip:+1-212-555-1212:1234@gateway.com;user=phone", "+1-212-555-1212", "gateway.com", ""},
+		{"sip:bob@[2001:db8::10]:5070?Subject=x@y", "bob", "2001:db8::10", "x@y"},
+	}
+	for _, test := range tests {
+		uri, err := ParseUri(test.uri)
+		if err != nil {
+			t.Errorf("%s: %v", test.uri, err)
+			continue
+		}
+		subject, _ := uri.Headers.Get("Subject")
+		if uri.User != test.user || uri.Host != test.host || subject != test.headers {
+			t.Errorf("%s: got user %q, host %q, Subject %q", test.uri, uri.User, uri.Host, subject)
+		}
+	}
+}
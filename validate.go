@@ -0,0 +1,102 @@
+package sip
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseError is returned for messages which could not be parsed or which
+// violate RFC 3261. Code is the status code a UAS should answer with, or 0
+// if the message cannot be answered at all (e.g. a malformed response).
+// Message holds whatever could be parsed, so that a reply can be built.
+type ParseError struct {
+	Code    int
+	Detail  string
+	Message *Message
+}
+
+func (e *ParseError) Error() string {
+	if e.Code == 0 {
+		return "Invalid message: " + e.Detail
+	}
+	return fmt.Sprintf("%d %s: %s", e.Code, ReasonPhrase(e.Code), e.Detail)
+}
+
+func newParseError(code int, detail string) *ParseError {
+	return &ParseError{Code: code, Detail: detail}
+}
+
+var singleValuedHeaders = []string{"To", "From", "Call-ID", "CSeq", "Max-Forwards", "Content-Length", "Content-Type", "Expires"}
+
+// Validate checks the mandatory headers and their syntax. Parsed messages
+// are validated automatically by ParseMessage and Parser.
+func (m *Message) Validate() error {
+	request, isRequest := m.Headline.(RequestHeadline)
+	if isRequest && request.Version != "SIP/"+sipversion {
+		return newParseError(505, "Unsupported version "+request.Version)
+	}
+
+	for _, name := range []string{"To", "From", "Call-ID", "CSeq", "Via"} {
+		if len(m.Headers.FindHeadersByName(name)) == 0 {
+			return newParseError(400, "Missing header "+name)
+		}
+	}
+	for _, name := range singleValuedHeaders {
+		if len(m.Headers.FindHeadersByName(name)) > 1 {
+			return newParseError(400, "Multiple values for "+name)
+		}
+	}
+
+	if _, err := m.FromAddress(); err != nil {
+		return newParseError(400, "Malformed From: "+err.Error())
+	}
+	if _, err := m.ToAddress(); err != nil {
+		return newParseError(400, "Malformed To: "+err.Error())
+	}
+	if _, err := m.Vias(); err != nil {
+		return newParseError(400, "Malformed Via: "+err.Error())
+	}
+	if _, err := m.Contacts(); err != nil {
+		return newParseError(400, "Malformed Contact: "+err.Error())
+	}
+
+	cseq, _ := m.Headers.FindHeaderByName("CSeq")
+	cseqFields := strings.Fields(cseq.Value)
+	if len(cseqFields) != 2 || !isToken(cseqFields[1]) {
+		return newParseError(400, "Malformed CSeq: "+cseq.Value)
+	}
+	if !isUintBelow(cseqFields[0], 1<<31) {
+		return newParseError(400, "CSeq number out of range: "+cseqFields[0])
+	}
+	if maxForwards, err := m.Headers.FindHeaderByName("Max-Forwards"); err == nil && !isUintBelow(maxForwards.Value, 256) {
+		return newParseError(400, "Malformed Max-Forwards: "+maxForwards.Value)
+	}
+	if expires, err := m.Headers.FindHeaderByName("Expires"); err == nil && !isUintBelow(expires.Value, 1<<32) {
+		return newParseError(400, "Malformed Expires: "+expires.Value)
+	}
+
+	if isRequest {
+		if cseqFields[1] != request.Method {
+			return newParseError(400, "CSeq method "+cseqFields[1]+" does not match "+request.Method)
+		}
+		switch request.Uri.Scheme {
+		case "sip", "sips", "tel":
+		default:
+			return newParseError(416, "Unsupported URI scheme: "+request.Uri.String())
+		}
+		if len(request.Uri.Headers) > 0 {
+			return newParseError(400, "Request-URI must not contain headers")
+		}
+	}
+	return nil
+}
+
+func isUintBelow(s string, limit uint64) bool {
+	s = strings.TrimSpace(s)
+	if !isDigits(s) {
+		return false
+	}
+	value, err := strconv.ParseUint(s, 10, 64)
+	return err == nil && value < limit
+}